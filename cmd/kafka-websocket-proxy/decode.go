@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/maxwellpeterson/kafka-websocket-shim/pkg/shim"
+)
+
+const (
+	int32Size = 4
+	int16Size = 2
+
+	apiKeyProduce          = 0
+	apiKeySaslHandshake    = 17
+	apiKeySaslAuthenticate = 36
+
+	// The first flexible version of SaslAuthenticate. SaslHandshake has no
+	// flexible versions
+	saslAuthenticateFlexibleVersion = 2
+)
+
+// The first version of each API that includes throttle_time_ms as the first
+// field of the response body. Produce is the odd one out, since it puts the
+// field at the end of the response body instead (see throttleTime)
+var throttleVersions = map[int16]int16{
+	apiKeyProduce: 1,
+	1:             1, // Fetch
+	2:             2, // ListOffsets
+	3:             3, // Metadata
+	8:             3, // OffsetCommit
+	9:             3, // OffsetFetch
+	10:            1, // FindCoordinator
+	11:            2, // JoinGroup
+	12:            1, // Heartbeat
+	13:            1, // LeaveGroup
+	14:            1, // SyncGroup
+	15:            1, // DescribeGroups
+	16:            1, // ListGroups
+	19:            2, // CreateTopics
+	20:            1, // DeleteTopics
+	21:            0, // DeleteRecords
+	22:            0, // InitProducerId
+	23:            2, // OffsetForLeaderEpoch
+	24:            0, // AddPartitionsToTxn
+	25:            0, // AddOffsetsToTxn
+	26:            0, // EndTxn
+	28:            0, // TxnOffsetCommit
+	29:            0, // DescribeAcls
+	30:            0, // CreateAcls
+	31:            0, // DeleteAcls
+	32:            0, // DescribeConfigs
+	33:            0, // AlterConfigs
+	37:            0, // CreatePartitions
+}
+
+// The first flexible version of each API in throttleVersions. Responses to
+// flexible versions have a tagged field section in the response header, which
+// needs to be skipped to find the start of the response body
+var flexibleVersions = map[int16]int16{
+	apiKeyProduce: 9,
+	1:             12,
+	2:             6,
+	3:             9,
+	8:             8,
+	9:             6,
+	10:            3,
+	11:            6,
+	12:            4,
+	13:            4,
+	14:            4,
+	15:            5,
+	16:            3,
+	19:            5,
+	20:            4,
+	21:            2,
+	22:            2,
+	23:            4,
+	24:            3,
+	25:            3,
+	26:            3,
+	28:            3,
+	29:            2,
+	30:            2,
+	31:            2,
+	32:            4,
+	33:            2,
+	37:            2,
+}
+
+// The fields common to all Kafka request headers
+type requestHeader struct {
+	apiKey        int16
+	apiVersion    int16
+	correlationID int32
+}
+
+func parseRequestHeader(msg []byte) (requestHeader, bool) {
+	if len(msg) < 2*int16Size+int32Size {
+		return requestHeader{}, false
+	}
+	return requestHeader{
+		apiKey:        int16(binary.BigEndian.Uint16(msg)),
+		apiVersion:    int16(binary.BigEndian.Uint16(msg[int16Size:])),
+		correlationID: int32(binary.BigEndian.Uint32(msg[2*int16Size:])),
+	}, true
+}
+
+// Splits a stream of Kafka protocol messages into individual messages, using
+// the same size header logic as shim.Conn
+type splitter struct {
+	buf []byte
+	// Set once a message declares a size over the maximum, after which the
+	// stream isn't split any further
+	lost bool
+}
+
+// Calls fn with each message (excluding the size header) that is completed by
+// b. Incomplete messages are buffered until a later call completes them
+//
+// A message that declares a size over shim.DefaultMaxMessageSize means the
+// size headers can't be trusted from there on, so rather than buffering up to
+// 4GB waiting for it, the bytes from that message on are returned unsplit, as
+// is b in every later call
+func (s *splitter) split(b []byte, fn func(msg []byte)) []byte {
+	if s.lost {
+		return b
+	}
+	s.buf = append(s.buf, b...)
+	for len(s.buf) >= int32Size {
+		// Kept unsigned, so that a size with the high bit set can't turn
+		// negative and slip past the length check, even where int is 32 bits
+		size := binary.BigEndian.Uint32(s.buf)
+		if size > shim.DefaultMaxMessageSize {
+			s.lost = true
+			rest := s.buf
+			s.buf = nil
+			return rest
+		}
+		if uint64(len(s.buf[int32Size:])) < uint64(size) {
+			return nil
+		}
+		fn(s.buf[int32Size : int32Size+int(size)])
+		s.buf = s.buf[int32Size+int(size):]
+	}
+	return nil
+}
+
+// A SaslHandshake or SaslAuthenticate request or response seen by the decoder
+type saslMessage struct {
+	h        requestHeader
+	response bool
+	// The error code of a response, which is only set if it could be decoded
+	errorCode    int16
+	hasErrorCode bool
+}
+
+// Decodes the Kafka protocol messages flowing through a single proxied
+// connection. Requests are tracked by correlation ID so that the matching
+// responses (which don't include the API key or version) can be decoded
+//
+// Note: Decoding buffers each message in full, so it's meant as a diagnostic
+// tool rather than something to leave on for high-throughput clients
+type decoder struct {
+	// Called with the throttle time of each response that has a non-zero
+	// throttle time, which means the broker is enforcing a quota. Ignored if
+	// nil
+	throttled func(h requestHeader, throttleMs int32)
+	// Called with each SASL request and response, which shows whether
+	// authentication made it through the proxy intact. Ignored if nil
+	//
+	// Note: With SaslHandshake v0, the SASL tokens that follow the handshake
+	// aren't wrapped in Kafka requests, so they aren't reported
+	sasl func(m saslMessage)
+
+	requests  splitter
+	responses splitter
+
+	mu       sync.Mutex
+	inflight map[int32]requestHeader
+}
+
+func newDecoder(throttled func(h requestHeader, throttleMs int32), sasl func(m saslMessage)) *decoder {
+	return &decoder{throttled: throttled, sasl: sasl, inflight: make(map[int32]requestHeader)}
+}
+
+// Observes bytes flowing from the client to the broker
+func (d *decoder) observeRequests(b []byte) {
+	d.requests.split(b, func(msg []byte) {
+		h, ok := parseRequestHeader(msg)
+		if !ok {
+			return
+		}
+		d.mu.Lock()
+		d.inflight[h.correlationID] = h
+		d.mu.Unlock()
+		if d.sasl != nil && isSASL(h.apiKey) {
+			d.sasl(saslMessage{h: h})
+		}
+	})
+}
+
+// Observes bytes flowing from the broker to the client
+func (d *decoder) observeResponses(b []byte) {
+	d.responses.split(b, func(msg []byte) {
+		if len(msg) < int32Size {
+			return
+		}
+		correlationID := int32(binary.BigEndian.Uint32(msg))
+		d.mu.Lock()
+		h, ok := d.inflight[correlationID]
+		delete(d.inflight, correlationID)
+		d.mu.Unlock()
+		if !ok {
+			return
+		}
+		if d.sasl != nil && isSASL(h.apiKey) {
+			m := saslMessage{h: h, response: true}
+			m.errorCode, m.hasErrorCode = saslErrorCode(h, msg)
+			d.sasl(m)
+		}
+		if d.throttled == nil {
+			return
+		}
+		if ms, ok := throttleTime(h, msg); ok && ms > 0 {
+			d.throttled(h, ms)
+		}
+	})
+}
+
+func isSASL(apiKey int16) bool {
+	return apiKey == apiKeySaslHandshake || apiKey == apiKeySaslAuthenticate
+}
+
+// Extracts error_code from a response (excluding the size header) to the SASL
+// request with header h, which is the first field of the response body
+func saslErrorCode(h requestHeader, msg []byte) (int16, bool) {
+	body := msg[int32Size:]
+	if h.apiKey == apiKeySaslAuthenticate && h.apiVersion >= saslAuthenticateFlexibleVersion {
+		n, ok := skipTaggedFields(body)
+		if !ok {
+			return 0, false
+		}
+		body = body[n:]
+	}
+	if len(body) < int16Size {
+		return 0, false
+	}
+	return int16(binary.BigEndian.Uint16(body)), true
+}
+
+// Extracts throttle_time_ms from a response (excluding the size header) to the
+// request with header h, if the response includes it
+func throttleTime(h requestHeader, msg []byte) (int32, bool) {
+	minVersion, ok := throttleVersions[h.apiKey]
+	if !ok || h.apiVersion < minVersion {
+		return 0, false
+	}
+	body := msg[int32Size:]
+	flexible := h.apiVersion >= flexibleVersions[h.apiKey]
+	if flexible {
+		n, ok := skipTaggedFields(body)
+		if !ok {
+			return 0, false
+		}
+		body = body[n:]
+	}
+	if h.apiKey == apiKeyProduce {
+		// Produce responses put throttle_time_ms at the end of the body, which
+		// is followed by a tagged field section in flexible versions. We only
+		// handle the common case where this section is empty (a single zero
+		// byte), since anything else would require decoding the whole body
+		if flexible {
+			if len(body) == 0 || body[len(body)-1] != 0 {
+				return 0, false
+			}
+			body = body[:len(body)-1]
+		}
+		if len(body) < int32Size {
+			return 0, false
+		}
+		return int32(binary.BigEndian.Uint32(body[len(body)-int32Size:])), true
+	}
+	if len(body) < int32Size {
+		return 0, false
+	}
+	return int32(binary.BigEndian.Uint32(body)), true
+}
+
+// Returns the length of the tagged field section at the start of b
+func skipTaggedFields(b []byte) (int, bool) {
+	count, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, false
+	}
+	offset := n
+	for i := uint64(0); i < count; i++ {
+		// Each tagged field is a tag followed by the size of its data
+		if _, n := binary.Uvarint(b[offset:]); n > 0 {
+			offset += n
+		} else {
+			return 0, false
+		}
+		size, n := binary.Uvarint(b[offset:])
+		if n <= 0 || uint64(len(b[offset+n:])) < size {
+			return 0, false
+		}
+		offset += n + int(size)
+	}
+	return offset, true
+}
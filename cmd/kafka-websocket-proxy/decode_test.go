@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Builds a Kafka protocol message (including the size header) from fields
+func MakeKafkaMsg(fields ...interface{}) []byte {
+	msg := make([]byte, int32Size)
+	for _, f := range fields {
+		switch v := f.(type) {
+		case int16:
+			msg = binary.BigEndian.AppendUint16(msg, uint16(v))
+		case int32:
+			msg = binary.BigEndian.AppendUint32(msg, uint32(v))
+		case []byte:
+			msg = append(msg, v...)
+		}
+	}
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)-int32Size))
+	return msg
+}
+
+type Throttle struct {
+	h  requestHeader
+	ms int32
+}
+
+func RecordThrottles() (*decoder, *[]Throttle) {
+	var throttles []Throttle
+	d := newDecoder(func(h requestHeader, ms int32) {
+		throttles = append(throttles, Throttle{h, ms})
+	}, nil)
+	return d, &throttles
+}
+
+func TestThrottleFirstField(t *testing.T) {
+	d, throttles := RecordThrottles()
+
+	// Metadata v1 doesn't include throttle_time_ms, v4 does
+	d.observeRequests(MakeKafkaMsg(int16(3), int16(1), int32(7), []byte("client")))
+	d.observeRequests(MakeKafkaMsg(int16(3), int16(4), int32(8), []byte("client")))
+	d.observeResponses(MakeKafkaMsg(int32(7), []byte{0, 0, 0, 1}))
+	d.observeResponses(MakeKafkaMsg(int32(8), int32(250), []byte("brokers")))
+
+	assert.Equal(t, []Throttle{{requestHeader{3, 4, 8}, 250}}, *throttles)
+}
+
+func TestThrottleFlexible(t *testing.T) {
+	d, throttles := RecordThrottles()
+
+	// Fetch v12 is flexible, so the response header has a tagged field
+	// section, which contains a single tagged field here
+	d.observeRequests(MakeKafkaMsg(int16(1), int16(12), int32(1)))
+	resp := MakeKafkaMsg(int32(1), []byte{1, 5, 2, 0xaa, 0xbb}, int32(100), int16(0))
+
+	// Responses can be split across reads arbitrarily
+	d.observeResponses(resp[:3])
+	assert.Empty(t, *throttles)
+	d.observeResponses(resp[3:])
+
+	assert.Equal(t, []Throttle{{requestHeader{1, 12, 1}, 100}}, *throttles)
+}
+
+func TestThrottleProduce(t *testing.T) {
+	d, throttles := RecordThrottles()
+
+	// Produce puts throttle_time_ms at the end of the response body, followed
+	// by an empty tagged field section in flexible versions
+	d.observeRequests(MakeKafkaMsg(int16(0), int16(3), int32(1)))
+	d.observeRequests(MakeKafkaMsg(int16(0), int16(9), int32(2)))
+	d.observeResponses(MakeKafkaMsg(int32(1), []byte("responses"), int32(30)))
+	d.observeResponses(MakeKafkaMsg(int32(2), []byte{0}, []byte("responses"), int32(40), []byte{0}))
+
+	assert.Equal(t, []Throttle{
+		{requestHeader{0, 3, 1}, 30},
+		{requestHeader{0, 9, 2}, 40},
+	}, *throttles)
+}
+
+func TestThrottleZero(t *testing.T) {
+	d, throttles := RecordThrottles()
+
+	d.observeRequests(MakeKafkaMsg(int16(12), int16(1), int32(1)))
+	d.observeResponses(MakeKafkaMsg(int32(1), int32(0), int16(0)))
+
+	// Unmatched responses are ignored
+	d.observeResponses(MakeKafkaMsg(int32(2), int32(500), int16(0)))
+
+	assert.Empty(t, *throttles)
+}
+
+func TestSASL(t *testing.T) {
+	var msgs []saslMessage
+	d := newDecoder(nil, func(m saslMessage) {
+		msgs = append(msgs, m)
+	})
+
+	// SaslHandshake v1, then SaslAuthenticate v2, which is flexible. Other
+	// requests aren't reported
+	d.observeRequests(MakeKafkaMsg(int16(18), int16(3), int32(1)))
+	d.observeResponses(MakeKafkaMsg(int32(1), int16(0)))
+	d.observeRequests(MakeKafkaMsg(int16(17), int16(1), int32(2), []byte("PLAIN")))
+	d.observeResponses(MakeKafkaMsg(int32(2), int16(0), []byte("mechanisms")))
+	d.observeRequests(MakeKafkaMsg(int16(36), int16(2), int32(3), []byte("token")))
+	d.observeResponses(MakeKafkaMsg(int32(3), []byte{0}, int16(58), []byte("error")))
+
+	assert.Equal(t, []saslMessage{
+		{h: requestHeader{17, 1, 2}},
+		{h: requestHeader{17, 1, 2}, response: true, hasErrorCode: true},
+		{h: requestHeader{36, 2, 3}},
+		{h: requestHeader{36, 2, 3}, response: true, errorCode: 58, hasErrorCode: true},
+	}, msgs)
+}
+
+func TestSplitOversized(t *testing.T) {
+	var s splitter
+	var msgs [][]byte
+	record := func(msg []byte) {
+		msgs = append(msgs, append([]byte(nil), msg...))
+	}
+
+	// A size of 0xffffffff is taken as 4GB, rather than turning negative,
+	// and the stream isn't split after it
+	bogus := []byte{0xff, 0xff, 0xff, 0xff, 'k', 'a'}
+	assert.Empty(t, s.split(MakeKafkaMsg(int32(1))[:6], record))
+	assert.Equal(t, bogus, s.split(append(MakeKafkaMsg(int32(1))[6:], bogus...), record))
+	assert.Equal(t, []byte("fka"), s.split([]byte("fka"), record))
+	assert.Equal(t, [][]byte{{0, 0, 0, 1}}, msgs)
+}
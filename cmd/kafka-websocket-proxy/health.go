@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/maxwellpeterson/kafka-websocket-shim/pkg/shim"
+)
+
+const (
+	readyDialTimeout = time.Second
+)
+
+// Serves liveness and readiness probes for the proxy. The liveness probe passes
+// as long as the process is up, so that the container isn't restarted in the
+// middle of a graceful shutdown. The readiness probe fails until the TCP
+// listener is up, and fails again once graceful shutdown starts, so that no new
+// clients are routed to a proxy that is draining its connections
+//
+// Also serves a status snapshot for operators, built from the proxy metrics
+type health struct {
+	broker  string
+	metrics *proxyMetrics
+	start   time.Time
+	serving atomic.Bool
+	mux     *http.ServeMux
+}
+
+func newHealth(broker string, metrics *proxyMetrics) *health {
+	h := &health{broker: broker, metrics: metrics, start: time.Now(), mux: http.NewServeMux()}
+	h.mux.HandleFunc("/healthz", h.healthz)
+	h.mux.HandleFunc("/readyz", h.readyz)
+	h.mux.HandleFunc("/status", h.status)
+	return h
+}
+
+// Marks whether the proxy is accepting new connections
+func (h *health) setServing(serving bool) {
+	h.serving.Store(serving)
+}
+
+func (h *health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *health) healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *health) readyz(w http.ResponseWriter, r *http.Request) {
+	if !h.serving.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	// A plain TCP dial is enough to tell whether the broker is reachable, and
+	// avoids opening a WebSocket connection for every probe
+	d := net.Dialer{Timeout: readyDialTimeout}
+	conn, err := d.DialContext(r.Context(), "tcp", h.broker)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	conn.Close()
+	w.WriteHeader(http.StatusOK)
+}
+
+type status struct {
+	Version           string     `json:"version"`
+	Broker            string     `json:"broker"`
+	UptimeSeconds     float64    `json:"uptime_seconds"`
+	ActiveConnections int        `json:"active_connections"`
+	LastDial          *time.Time `json:"last_successful_dial"`
+}
+
+func (h *health) status(w http.ResponseWriter, r *http.Request) {
+	s := status{
+		Version:           shim.Version,
+		Broker:            h.broker,
+		UptimeSeconds:     time.Since(h.start).Seconds(),
+		ActiveConnections: int(h.metrics.activeConns.value("")),
+	}
+	if t, ok := h.metrics.lastDialTime(); ok {
+		s.LastDial = &t
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
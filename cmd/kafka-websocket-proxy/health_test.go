@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maxwellpeterson/kafka-websocket-shim/pkg/shim"
+	"github.com/stretchr/testify/assert"
+)
+
+func Probe(h http.Handler, path string) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code
+}
+
+func TestHealth(t *testing.T) {
+	// Stands in for the broker, since readiness only needs a TCP dial
+	ln, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+
+	h := newHealth(ln.Addr().String(), newProxyMetrics())
+	assert.Equal(t, http.StatusOK, Probe(h, "/healthz"), "alive before listening")
+	assert.Equal(t, http.StatusServiceUnavailable, Probe(h, "/readyz"), "not ready before listening")
+
+	h.setServing(true)
+	assert.Equal(t, http.StatusOK, Probe(h, "/healthz"), "alive while listening")
+	assert.Equal(t, http.StatusOK, Probe(h, "/readyz"), "ready while listening")
+
+	h.setServing(false)
+	assert.Equal(t, http.StatusOK, Probe(h, "/healthz"), "alive during shutdown")
+	assert.Equal(t, http.StatusServiceUnavailable, Probe(h, "/readyz"), "not ready during shutdown")
+}
+
+func TestReadyBrokerDown(t *testing.T) {
+	// Nothing is listening on the address of a closed listener
+	ln, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	broker := ln.Addr().String()
+	assert.Nil(t, ln.Close())
+
+	h := newHealth(broker, newProxyMetrics())
+	h.setServing(true)
+	assert.Equal(t, http.StatusOK, Probe(h, "/healthz"), "alive while listening")
+	assert.Equal(t, http.StatusServiceUnavailable, Probe(h, "/readyz"), "not ready when broker is down")
+}
+
+func Status(t *testing.T, h http.Handler) status {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var s status
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &s))
+	return s
+}
+
+func TestStatus(t *testing.T) {
+	addr, stop := StartBroker(t)
+	defer stop()
+
+	h := newHealth(addr, metrics)
+	s := Status(t, h)
+	assert.Equal(t, shim.Version, s.Version)
+	assert.Equal(t, addr, s.Broker)
+	assert.Equal(t, 0, s.ActiveConnections)
+
+	client, server := TCPPair(t)
+	done := make(chan error)
+	go func() {
+		dialer := shim.NewDialer(shim.DialerConfig{})
+		done <- handleClient(context.Background(), server, dialer, addr, logger)
+	}()
+	// Wait for a proxied round trip, so the broker has been dialed
+	msg := []byte{0, 0, 0, 1, 'k'}
+	_, err := client.Write(msg)
+	assert.Nil(t, err)
+	_, err = client.Read(make([]byte, len(msg)))
+	assert.Nil(t, err)
+
+	s = Status(t, h)
+	assert.Equal(t, 1, s.ActiveConnections)
+	if assert.NotNil(t, s.LastDial) {
+		assert.WithinDuration(t, time.Now(), *s.LastDial, 5*time.Second)
+	}
+	assert.Greater(t, s.UptimeSeconds, float64(0))
+
+	assert.Nil(t, client.Close())
+	assert.Nil(t, <-done)
+	assert.Equal(t, 0, Status(t, h).ActiveConnections)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/maxwellpeterson/kafka-websocket-shim/pkg/shim"
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns a connected pair of TCP connections, so that the proxy side has a
+// real remote address
+func TCPPair(t testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	server, err := ln.Accept()
+	assert.Nil(t, err)
+	return client, server
+}
+
+// Parses JSON log lines, returning the records with the given message
+func FindLogs(t *testing.T, logs *bytes.Buffer, msg string) []map[string]interface{} {
+	var found []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &record))
+		if record["msg"] == msg {
+			found = append(found, record)
+		}
+	}
+	return found
+}
+
+func TestConnectionLogs(t *testing.T) {
+	addr, stop := StartBroker(t)
+	defer stop()
+
+	var logs bytes.Buffer
+	l, err := newLogger(&logs, "debug", "json")
+	assert.Nil(t, err)
+
+	client, server := TCPPair(t)
+	remoteAddr := server.RemoteAddr().String()
+	done := make(chan error)
+	go func() {
+		dialer := shim.NewDialer(shim.DialerConfig{})
+		done <- handleClient(context.Background(), server, dialer, addr, l.With("remote_addr", remoteAddr))
+	}()
+
+	// Wait for the proxied round trip before closing the client
+	msg := []byte{0, 0, 0, 1, 'k'}
+	_, err = client.Write(msg)
+	assert.Nil(t, err)
+	_, err = client.Read(make([]byte, len(msg)))
+	assert.Nil(t, err)
+	assert.Nil(t, client.Close())
+	assert.Nil(t, <-done)
+
+	records := FindLogs(t, &logs, "opened websocket connection")
+	assert.Len(t, records, 1)
+	if len(records) == 1 {
+		assert.Equal(t, "INFO", records[0]["level"])
+		assert.Equal(t, remoteAddr, records[0]["remote_addr"])
+		assert.Equal(t, addr, records[0]["broker"])
+		assert.Contains(t, records[0], "broker_addr")
+	}
+}
+
+func TestConnectionSummaryLogs(t *testing.T) {
+	addr, stop := StartBroker(t)
+	defer stop()
+
+	var logs bytes.Buffer
+	l, err := newLogger(&logs, "info", "json")
+	assert.Nil(t, err)
+
+	client, server := TCPPair(t)
+	done := make(chan error)
+	go func() {
+		dialer := shim.NewDialer(shim.DialerConfig{})
+		done <- handleClient(context.Background(), server, dialer, addr, l)
+	}()
+
+	// The stub broker echoes every message, so the same number of bytes is
+	// piped in each direction
+	msg := []byte{0, 0, 0, 4, 'k', 'a', 'f', 'k'}
+	for i := 0; i < 3; i++ {
+		_, err = client.Write(msg)
+		assert.Nil(t, err)
+		_, err = io.ReadFull(client, make([]byte, len(msg)))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, client.Close())
+	assert.Nil(t, <-done)
+
+	records := FindLogs(t, &logs, "connection summary")
+	assert.Len(t, records, 1)
+	if len(records) == 1 {
+		assert.Equal(t, float64(3*len(msg)), records[0]["bytes_up"])
+		assert.Equal(t, float64(3*len(msg)), records[0]["bytes_down"])
+		assert.Greater(t, records[0]["duration"], float64(0))
+	}
+}
+
+func TestAPIKeyLogs(t *testing.T) {
+	defer func(v bool) { *logAPIKeys = v }(*logAPIKeys)
+	*logAPIKeys = true
+
+	addr, stop := StartBroker(t)
+	defer stop()
+
+	var logs bytes.Buffer
+	l, err := newLogger(&logs, "info", "json")
+	assert.Nil(t, err)
+
+	client, server := TCPPair(t)
+	done := make(chan error)
+	go func() {
+		dialer := shim.NewDialer(shim.DialerConfig{})
+		done <- handleClient(context.Background(), server, dialer, addr, l)
+	}()
+
+	// A Produce v9 request, split across writes. Only the request direction
+	// is logged, even though the stub broker echoes it back
+	req := MakeKafkaMsg(int16(0), int16(9), int32(42), KafkaString("client"), []byte("records"))
+	for _, b := range [][]byte{req[:6], req[6:]} {
+		_, err = client.Write(b)
+		assert.Nil(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = io.ReadFull(client, make([]byte, len(req)))
+	assert.Nil(t, err)
+	assert.Nil(t, client.Close())
+	assert.Nil(t, <-done)
+
+	records := FindLogs(t, &logs, "forwarded request")
+	assert.Len(t, records, 1)
+	if len(records) == 1 {
+		assert.Equal(t, float64(0), records[0]["api_key"])
+		assert.Equal(t, float64(9), records[0]["api_version"])
+		assert.Equal(t, float64(42), records[0]["correlation_id"])
+	}
+}
+
+func TestSASLLogs(t *testing.T) {
+	defer func(v bool) { *logSASL = v }(*logSASL)
+	*logSASL = true
+
+	req := MakeKafkaMsg(int16(17), int16(1), int32(9), KafkaString("client"), KafkaString("PLAIN"))
+	resp := MakeKafkaMsg(int32(9), int16(33), int32(1), KafkaString("SCRAM-SHA-512"))
+	received := make(chan []byte, 1)
+	addr, stop := StartBrokerHandler(t, func(c *websocket.Conn) {
+		_, p, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		received <- p
+		c.WriteMessage(websocket.BinaryMessage, resp)
+		c.ReadMessage()
+	})
+	defer stop()
+
+	var logs bytes.Buffer
+	l, err := newLogger(&logs, "info", "json")
+	assert.Nil(t, err)
+
+	client, server := TCPPair(t)
+	done := make(chan error)
+	go func() {
+		dialer := shim.NewDialer(shim.DialerConfig{})
+		done <- handleClient(context.Background(), server, dialer, addr, l)
+	}()
+
+	// The handshake is forwarded untouched in both directions
+	_, err = client.Write(req)
+	assert.Nil(t, err)
+	got := make([]byte, len(resp))
+	_, err = io.ReadFull(client, got)
+	assert.Nil(t, err)
+	assert.Equal(t, resp, got)
+	assert.Equal(t, req, <-received)
+	assert.Nil(t, client.Close())
+	assert.Nil(t, <-done)
+
+	records := FindLogs(t, &logs, "forwarded sasl request")
+	assert.Len(t, records, 1)
+	if len(records) == 1 {
+		assert.Equal(t, float64(17), records[0]["api_key"])
+		assert.Equal(t, float64(1), records[0]["api_version"])
+		assert.Equal(t, float64(9), records[0]["correlation_id"])
+	}
+	records = FindLogs(t, &logs, "forwarded sasl response")
+	assert.Len(t, records, 1)
+	if len(records) == 1 {
+		assert.Equal(t, float64(17), records[0]["api_key"])
+		assert.Equal(t, float64(9), records[0]["correlation_id"])
+		// UNSUPPORTED_SASL_MECHANISM
+		assert.Equal(t, float64(33), records[0]["error_code"])
+	}
+}
+
+func TestDialTimingLogs(t *testing.T) {
+	var logs bytes.Buffer
+	l, err := newLogger(&logs, "info", "json")
+	assert.Nil(t, err)
+	defer func(l *slog.Logger) { logger = l }(logger)
+	logger = l
+
+	before := metrics.dialPhaseSeconds.value("upgrade")
+	recordDialTiming("localhost:8787", shim.DialTiming{
+		DNS:     time.Millisecond,
+		Connect: 2 * time.Millisecond,
+		Upgrade: 3 * time.Millisecond,
+		Total:   6 * time.Millisecond,
+	}, nil)
+
+	records := FindLogs(t, &logs, "traced broker dial")
+	assert.Len(t, records, 1)
+	if len(records) == 1 {
+		assert.Equal(t, float64(time.Millisecond), records[0]["dns"])
+		assert.Equal(t, float64(2*time.Millisecond), records[0]["connect"])
+		assert.Equal(t, float64(0), records[0]["tls_handshake"])
+		assert.Equal(t, float64(3*time.Millisecond), records[0]["upgrade"])
+		assert.Equal(t, float64(6*time.Millisecond), records[0]["total"])
+	}
+	assert.InDelta(t, 0.003, metrics.dialPhaseSeconds.value("upgrade")-before, 1e-9)
+}
+
+func TestNewLoggerInvalid(t *testing.T) {
+	_, err := newLogger(&bytes.Buffer{}, "loud", "text")
+	assert.EqualError(t, err, `invalid log level "loud"`)
+	_, err = newLogger(&bytes.Buffer{}, "info", "xml")
+	assert.EqualError(t, err, `invalid log format "xml"`)
+}
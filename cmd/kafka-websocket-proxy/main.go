@@ -2,13 +2,21 @@ package main
 
 import (
 	"context"
+	// Renamed to avoid clashing with the -tls flag
+	cryptotls "crypto/tls"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -20,134 +28,682 @@ import (
 
 const (
 	pipeBufSize       = 4096
+	maxPipeBufSize    = 16 << 20
 	dialBrokerRetries = 5
-	dialBrokerWait    = 200 * time.Millisecond
-	dialBrokerBackoff = 2
 )
 
 var (
-	port   = flag.String("port", "8080", "the port to listen on")
-	broker = flag.String("broker", "localhost:8787", "the address of the broker")
+	port   = flag.String("port", "8080", "the port to listen on, or a comma-separated list of ports")
+	listen = flag.String("listen", "", "the address to listen on, as host:port or unix:///path/to.sock, or a comma-separated list of addresses (overrides -port if set)")
+	broker = flag.String("broker", "localhost:8787", "the address of the broker as host:port, or a comma-separated list with one broker per listen address")
 	tls    = flag.Bool("tls", false, "use tls for the broker connection")
+
+	requireTLS = flag.Bool("require-tls", false, "refuse to connect to the broker without tls")
+
+	tlsCert = flag.String("tls-cert", "", "the certificate file for serving tls to clients (requires -tls-key)")
+	tlsKey  = flag.String("tls-key", "", "the private key file for serving tls to clients (requires -tls-cert)")
+
+	healthPort    = flag.String("health-port", "", "the port to serve health checks on (disabled if empty)")
+	shutdownDelay = flag.Duration("shutdown-delay", 0, "how long to keep accepting connections after reporting unready on shutdown")
+	drainTimeout  = flag.Duration("drain-timeout", 0, "how long to wait for open connections to close on shutdown before closing them")
+
+	maxConns       = flag.Int("max-conns", 0, "the maximum number of concurrent connections (unlimited if zero)")
+	maxConnsPolicy = flag.String("max-conns-policy", "reject", "what to do with new connections at the limit (reject or block)")
+
+	bufSize = flag.Int("buf-size", pipeBufSize, "the size of the buffer used to pipe data in each direction")
+
+	readTimeout  = flag.Duration("read-timeout", 0, "close connections when a read in either direction waits longer than this (disabled if zero)")
+	writeTimeout = flag.Duration("write-timeout", 0, "close connections when a write in either direction waits longer than this (disabled if zero)")
+
+	decode     = flag.Bool("decode", false, "decode kafka protocol messages and log broker throttling")
+	logAPIKeys = flag.Bool("log-api-keys", false, "log the api key, version, and correlation id of every kafka request that passes through")
+	logSASL    = flag.Bool("log-sasl", false, "log the sasl handshake and authenticate requests and responses that pass through, to tell broker auth failures apart from proxy problems")
+
+	rewriteMetadata = flag.Bool("rewrite-metadata", false, "rewrite the broker addresses in kafka metadata responses to the proxy's address, so that clients connect through the proxy")
+	advertiseHost   = flag.String("advertise-host", "", "the host to advertise with -rewrite-metadata (the local address the client connected to if empty)")
+
+	traceDial = flag.Bool("trace-dial", false, "log and report the time spent in each phase of broker dials")
+
+	dialBackoff           = flag.Duration("dial-backoff", 200*time.Millisecond, "how long to wait before retrying the first failed broker dial")
+	dialBackoffMultiplier = flag.Float64("dial-backoff-multiplier", 2, "how much to multiply the wait by after each failed broker dial")
+	dialBackoffJitter     = flag.Float64("dial-backoff-jitter", 1, "the fraction of each wait to randomize, from 0 (none) to 1 (full jitter)")
+	reconnectBroker       = flag.Bool("reconnect-broker", false, "redial the broker if its websocket connection fails, keeping the client connection open (note: a request in flight may be sent twice, or its response lost)")
+	dialTimeout           = flag.Duration("dial-timeout", 0, "how long to spend dialing the broker for a client across all retries before dropping the client (unlimited if zero)")
+
+	metricsPort = flag.String("metrics-port", "", "the port to serve prometheus metrics on (disabled if empty)")
+
+	logLevel  = flag.String("log-level", "info", "the minimum log level (debug, info, warn, or error)")
+	logFormat = flag.String("log-format", "text", "the log format (text or json)")
+
+	printVersion = flag.Bool("version", false, "print the version and exit")
+	probeBrokers = flag.Bool("probe", false, "dial each broker once, print the outcome of the websocket handshake, and exit (non-zero if a dial fails)")
+)
+
+var (
+	metrics = newProxyMetrics()
+	logger  = slog.Default()
 )
 
 func main() {
 	flag.Parse()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	dialer := shim.NewDialer(shim.DialerConfig{TLS: *tls})
+	if *printVersion {
+		fmt.Println(shim.Version)
+		os.Exit(0)
+	}
 
-	ln, err := net.Listen("tcp", ":"+*port)
+	l, err := newLogger(os.Stderr, *logLevel, *logFormat)
 	if err != nil {
-		log.Fatal(errors.Wrap(err, "start tcp listener failed"))
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	fmt.Printf("listening on port %s\n", *port)
+	logger = l
+	logger.Info("starting proxy", "version", shim.Version)
 
-	g, ctx := errgroup.WithContext(ctx)
-	g.Go(func() error {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				select {
-				case <-ctx.Done():
-					return nil
-				default:
-					// Returning error cancels context and triggers shutdown
-					return errors.Wrap(err, "tcp listener failed")
-				}
+	if *requireTLS && !*tls {
+		// Fail fast, rather than refusing every broker dial later on
+		fatal(errors.New("require-tls is set but tls is disabled"))
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fatal(errors.New("tls-cert and tls-key must be set together"))
+	}
+	if err := validateBufSize(*bufSize); err != nil {
+		fatal(err)
+	}
+	if *dialBackoffMultiplier < 1 {
+		fatal(errors.New("dial-backoff-multiplier must be at least 1"))
+	}
+	if *dialBackoffJitter < 0 || *dialBackoffJitter > 1 {
+		fatal(errors.New("dial-backoff-jitter must be between 0 and 1"))
+	}
+	if *advertiseHost != "" && !*rewriteMetadata {
+		fatal(errors.New("advertise-host is set but rewrite-metadata is disabled"))
+	}
+	if *maxConns < 0 {
+		fatal(errors.New("max-conns must not be negative"))
+	}
+	if *maxConnsPolicy != "reject" && *maxConnsPolicy != "block" {
+		fatal(errors.Errorf("invalid max-conns-policy %q", *maxConnsPolicy))
+	}
+
+	addrs, brokers, err := listenBrokers(*listen, *port, *broker)
+	if err != nil {
+		fatal(err)
+	}
+	if *probeBrokers {
+		timeout := *dialTimeout
+		if timeout == 0 {
+			timeout = defaultProbeTimeout
+		}
+		if !probe(os.Stdout, brokers, shim.DialerConfig{TLS: *tls, RequireTLS: *requireTLS, Logger: logger}, timeout) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	var shutdownTracing func(context.Context) error
+	if setupTracing != nil {
+		if shutdownTracing, err = setupTracing(context.Background()); err != nil {
+			fatal(errors.Wrap(err, "set up tracing failed"))
+		}
+	}
+
+	var tlsConfig *cryptotls.Config
+	if *tlsCert != "" {
+		// Encrypts the client side of the proxy, independently of -tls
+		cert, err := cryptotls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			fatal(errors.Wrap(err, "load tls certificate failed"))
+		}
+		tlsConfig = &cryptotls.Config{Certificates: []cryptotls.Certificate{cert}}
+	}
+	lns := make([]net.Listener, len(addrs))
+	for i, addr := range addrs {
+		ln, err := listenAddr(addr)
+		if err != nil {
+			fatal(errors.Wrap(err, "start listener failed"))
+		}
+		if tlsConfig != nil {
+			ln = cryptotls.NewListener(ln, tlsConfig)
+		}
+		// The address is read back from the listener, so that the port the OS
+		// picked for -port 0 is reported. It's also logged on its own, so that
+		// scripts don't need to parse the address
+		attrs := []any{"addr", ln.Addr().String(), "broker", brokers[i]}
+		if tcpAddr, ok := ln.Addr().(*net.TCPAddr); ok {
+			attrs = append(attrs, "port", tcpAddr.Port)
+		}
+		logger.Info("listening for connections", attrs...)
+		lns[i] = ln
+	}
+
+	var hc *health
+	var hs *http.Server
+	if *healthPort != "" {
+		// With multiple listeners, readiness is based on the first broker
+		hc = newHealth(brokers[0], metrics)
+		hs = &http.Server{Addr: ":" + *healthPort, Handler: hc}
+		go func() {
+			if err := hs.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal(errors.Wrap(err, "health server failed"))
 			}
+		}()
+		hc.setServing(true)
+		logger.Info("serving health checks", "port", *healthPort)
+	}
 
-			connAddr := conn.RemoteAddr().String()
-			fmt.Printf("accepted tcp connection from %s\n", connAddr)
+	var ms *http.Server
+	if *metricsPort != "" {
+		ms = &http.Server{Addr: ":" + *metricsPort, Handler: metrics.registry}
+		go func() {
+			if err := ms.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal(errors.Wrap(err, "metrics server failed"))
+			}
+		}()
+		logger.Info("serving metrics", "port", *metricsPort)
+	}
 
-			g.Go(func() error {
-				if err := handleClient(ctx, conn, dialer); err != nil {
-					fmt.Printf("connection with %s failed: %v\n", connAddr, err)
-				} else {
-					fmt.Printf("closed tcp connection with %s\n", connAddr)
-				}
-				// Individual connections can fail without triggering shutdown
-				return nil
-			})
+	routes := make([]Route, len(lns))
+	for i, ln := range lns {
+		brokerAddr := brokers[i]
+		cfg := shim.DialerConfig{TLS: *tls, RequireTLS: *requireTLS, Logger: logger}
+		if *reconnectBroker {
+			// The dialer retries the dial itself, so that redials get the
+			// same jittered backoff as the first dial
+			cfg.Reconnect = true
+			cfg.RetryCount = dialBrokerRetries - 1
+			cfg.RetryBackoff = *dialBackoff
+			cfg.RetryMultiplier = *dialBackoffMultiplier
+			cfg.RetryJitter = *dialBackoffJitter
 		}
+		if *traceDial {
+			cfg.TraceDial = func(t shim.DialTiming, err error) {
+				recordDialTiming(brokerAddr, t, err)
+			}
+		}
+		routes[i] = Route{Listener: ln, Broker: brokerAddr, Dialer: shim.NewDialer(cfg)}
+	}
+	srv := NewServer(ServerConfig{
+		Routes:         routes,
+		MaxConns:       *maxConns,
+		MaxConnsPolicy: *maxConnsPolicy,
+		DrainTimeout:   *drainTimeout,
 	})
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(context.Background()) }()
 
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
 	select {
 	case s := <-sig:
-		fmt.Printf("received %s, starting graceful shutdown\n", s.String())
-		cancel()
-	case <-ctx.Done():
-		// TCP listener failed and triggered shutdown on its own
+		logger.Info("starting graceful shutdown", "signal", s.String())
+		if hc != nil {
+			// Report unready before closing the listener, so that load
+			// balancers have a chance to stop routing new clients to us
+			hc.setServing(false)
+			time.Sleep(*shutdownDelay)
+		}
+		srv.Shutdown()
+		err = <-done
+	case err = <-done:
+		// Listener failed and triggered shutdown on its own
+		if hc != nil {
+			hc.setServing(false)
+		}
+	}
+	if err != nil {
+		fatal(err)
 	}
 
-	if err := ln.Close(); err != nil {
-		log.Fatal(errors.Wrap(err, "close tcp listener failed"))
+	// Keep reporting unready until all connections have been closed
+	if hs != nil {
+		if err := hs.Shutdown(context.Background()); err != nil {
+			fatal(errors.Wrap(err, "close health server failed"))
+		}
+	}
+	if ms != nil {
+		if err := ms.Shutdown(context.Background()); err != nil {
+			fatal(errors.Wrap(err, "close metrics server failed"))
+		}
+	}
+	if shutdownTracing != nil {
+		if err := shutdownTracing(context.Background()); err != nil {
+			fatal(errors.Wrap(err, "flush traces failed"))
+		}
 	}
+}
 
-	if err := g.Wait(); err != nil {
-		log.Fatal(err)
+// Returns the addresses to listen on, from listen if set and port otherwise,
+// paired positionally with the broker each one forwards to. A single broker is
+// shared by all of the addresses
+func listenBrokers(listen string, port string, broker string) ([]string, []string, error) {
+	var addrs []string
+	if listen != "" {
+		addrs = strings.Split(listen, ",")
+	} else {
+		for _, p := range strings.Split(port, ",") {
+			addrs = append(addrs, ":"+p)
+		}
 	}
+	brokers := strings.Split(broker, ",")
+	for _, b := range brokers {
+		if err := validateBroker(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(brokers) == 1 {
+		for len(brokers) < len(addrs) {
+			brokers = append(brokers, brokers[0])
+		}
+	}
+	if len(brokers) != len(addrs) {
+		return nil, nil, errors.Errorf("got %d brokers for %d listen addresses", len(brokers), len(addrs))
+	}
+	return addrs, brokers, nil
 }
 
-func handleClient(ctx context.Context, conn net.Conn, dialer proxy.ContextDialer) error {
-	ws, err := dialBroker(ctx, dialer)
+// Shown with broker address errors, since the address is easy to get wrong,
+// and otherwise only fails once a client connects
+const brokerExample = "expected host:port, such as mybroker.workers.dev:443, or [::1]:8787 for an ipv6 host"
+
+// Checks that a broker address has a host and a port, so that a bad -broker
+// flag fails at startup rather than on the first dial
+func validateBroker(addr string) error {
+	if addr == "" {
+		return errors.Errorf("missing broker address (%s)", brokerExample)
+	}
+	// IPv6 brokers need brackets to tell the host from the port
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		var addrErr *net.AddrError
+		if errors.As(err, &addrErr) {
+			err = errors.New(addrErr.Err)
+		}
+		return errors.Errorf("invalid broker address %q: %v (%s)", addr, err, brokerExample)
+	}
+	if host == "" {
+		return errors.Errorf("invalid broker address %q: missing host (%s)", addr, brokerExample)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return errors.Errorf("invalid broker address %q: invalid port %q (%s)", addr, port, brokerExample)
+	}
+	return nil
+}
+
+// Listens on a TCP address (host:port), or on a Unix socket if addr has the
+// form unix:///path/to.sock. Closing the listener removes the socket file
+func listenAddr(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Creates a logger that writes to w with the given level and format
+func newLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, errors.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, errors.Errorf("invalid log format %q", format)
+	}
+}
+
+func fatal(err error) {
+	logger.Error(err.Error())
+	os.Exit(1)
+}
+
+// Forwards conn to the broker at brokerAddr. Log lines for the connection are
+// written to connLogger
+func handleClient(ctx context.Context, conn net.Conn, dialer proxy.ContextDialer, brokerAddr string, connLogger *slog.Logger) (err error) {
+	metrics.activeConns.add("", 1)
+	defer metrics.activeConns.add("", -1)
+
+	ctx, span := connTracer.Start(ctx, "proxy.connection")
+	span.SetAttributes(slog.String("broker", brokerAddr), slog.String("remote_addr", conn.RemoteAddr().String()))
+	if id := connIDFrom(ctx); id != "" {
+		span.SetAttributes(slog.String("conn_id", id))
+	}
+	defer func() { span.End(err) }()
+
+	header := http.Header{}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		// Lets the broker see the client's address rather than ours
+		header.Set("X-Forwarded-For", addr.IP.String())
+	}
+	if id := connIDFrom(ctx); id != "" {
+		// Lets the broker's logs be matched up with ours
+		header.Set("X-Request-Id", id)
+	}
+	dialCtx := ctx
+	if len(header) > 0 {
+		dialCtx = shim.WithRequestHeader(ctx, header)
+	}
+	if *dialTimeout > 0 {
+		// Bounds the retries as a whole, so that a client isn't kept waiting
+		// on a broker that is down for good
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(dialCtx, *dialTimeout)
+		defer cancel()
+	}
+	if tlsConn, ok := conn.(*cryptotls.Conn); ok {
+		// The handshake runs on the first read, and interrupting it (as the
+		// client watch below does) would leave the connection unusable
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return errors.Wrap(err, "tls handshake failed")
+		}
+	}
+	// A client that disconnects while the broker is dialed cancels the dial,
+	// rather than leaving it to retry for nobody
+	dialCtx, cancelDial := context.WithCancel(dialCtx)
+	defer cancelDial()
+	watch := watchClient(conn, *bufSize, cancelDial)
+	ws, err := dialBroker(dialCtx, dialer, brokerAddr, connLogger)
+	early, clientErr := watch.stop()
+	if clientErr != nil {
+		conn.Close()
+		if ws != nil {
+			ws.Close()
+		}
+		connLogger.Info("client closed during broker dial", "error", clientErr)
+		return nil
+	}
 	if err != nil {
 		defer conn.Close()
+		var statusErr shim.HandshakeStatusError
+		if errors.As(err, &statusErr) {
+			// Usually an auth or routing problem between us and the broker,
+			// which the client has no way of reporting
+			connLogger.Warn("broker rejected websocket upgrade", "broker", brokerAddr, "status", statusErr.StatusCode)
+		}
+		if ctx.Err() == nil && errors.Is(dialCtx.Err(), context.DeadlineExceeded) {
+			return errors.Errorf("dial broker timed out after %s: %v", *dialTimeout, err)
+		}
 		return errors.Wrap(err, "dial broker failed")
 	}
-	fmt.Printf("opened websocket connection with %s\n", ws.RemoteAddr().String())
+	connLogger.Info("opened websocket connection",
+		"broker", brokerAddr, "broker_addr", ws.RemoteAddr().String())
+
+	// Totals for the lifetime of the connection, for capacity planning
+	start := time.Now()
+	var bytesUp, bytesDown atomic.Int64
+	defer func() {
+		connLogger.Info("connection summary", "bytes_up", bytesUp.Load(),
+			"bytes_down", bytesDown.Load(), "duration", time.Since(start))
+		span.SetAttributes(slog.Int64("bytes_up", bytesUp.Load()), slog.Int64("bytes_down", bytesDown.Load()))
+	}()
+
+	var d *decoder
+	if *decode || *logSASL {
+		var throttled func(requestHeader, int32)
+		if *decode {
+			throttled = func(h requestHeader, throttleMs int32) {
+				connLogger.Info("broker throttled client", "throttle_ms", throttleMs,
+					"api_key", h.apiKey, "api_version", h.apiVersion)
+				metrics.throttleMs.add(strconv.Itoa(int(h.apiKey)), float64(throttleMs))
+			}
+		}
+		var sasl func(saslMessage)
+		if *logSASL {
+			sasl = func(m saslMessage) {
+				attrs := []any{"api_key", m.h.apiKey, "api_version", m.h.apiVersion, "correlation_id", m.h.correlationID}
+				if !m.response {
+					connLogger.Info("forwarded sasl request", attrs...)
+					return
+				}
+				if m.hasErrorCode {
+					attrs = append(attrs, "error_code", m.errorCode)
+				}
+				connLogger.Info("forwarded sasl response", attrs...)
+			}
+		}
+		d = newDecoder(throttled, sasl)
+	}
+	var requests *splitter
+	if *logAPIKeys {
+		requests = &splitter{}
+	}
+	observeRequests := func(b []byte) {
+		metrics.bytesPiped.add("upstream", float64(len(b)))
+		if d != nil {
+			d.observeRequests(b)
+		}
+		if requests != nil {
+			requests.split(b, func(msg []byte) {
+				if h, ok := parseRequestHeader(msg); ok {
+					connLogger.Info("forwarded request", "api_key", h.apiKey,
+						"api_version", h.apiVersion, "correlation_id", h.correlationID)
+				}
+			})
+		}
+	}
+	observeResponses := func(b []byte) {
+		metrics.bytesPiped.add("downstream", float64(len(b)))
+		if d != nil {
+			d.observeResponses(b)
+		}
+	}
+
+	toBroker, toClient := ws, conn
+	if *rewriteMetadata {
+		if host, port, ok := advertisedAddr(conn); ok {
+			r := newMetadataRewriter(host, port, connLogger)
+			toBroker, toClient = r.trackRequests(ws), r.rewriteResponses(conn)
+		} else {
+			connLogger.Warn("not rewriting metadata, since the client didn't connect over tcp")
+		}
+	}
 
+	if len(early) > 0 {
+		// Forward what the client sent while the broker was dialed first
+		if _, err := toBroker.Write(early); err != nil {
+			conn.Close()
+			ws.Close()
+			return errors.Wrap(err, "forward client data failed")
+		}
+		bytesUp.Add(int64(len(early)))
+		observeRequests(early)
+	}
+
+	timeouts := pipeTimeouts{read: *readTimeout, write: *writeTimeout}
+	ctx, pipeSpan := connTracer.Start(ctx, "proxy.pipe")
+	defer func() { pipeSpan.End(err) }()
 	g, ctx := errgroup.WithContext(ctx)
 	// Pipe data from TCP connection to WebSocket connection
-	g.Go(pipeFunc(ctx, conn, ws))
+	g.Go(pipeFunc(ctx, conn, toBroker, *bufSize, timeouts, &bytesUp, observeRequests))
 	g.Go(func() error {
 		<-ctx.Done()
 		return conn.Close()
 	})
 	// Pipe data from WebSocket connection to TCP connection
-	g.Go(pipeFunc(ctx, ws, conn))
+	g.Go(pipeFunc(ctx, ws, toClient, *bufSize, timeouts, &bytesDown, observeResponses))
 	g.Go(func() error {
 		<-ctx.Done()
 		return ws.Close()
 	})
 
 	if err := g.Wait(); err != nil && !errors.Is(err, io.EOF) {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// Both sides have been closed, and timing out is expected for
+			// stuck connections, so this isn't treated as a failure
+			connLogger.Info("connection timed out", "error", err)
+			return nil
+		}
 		return err
 	}
 	return nil
 }
 
+// Reads from a client while its broker connection is being dialed, so that the
+// dial can be cancelled if the client disconnects. Data that the client sends
+// in the meantime (Kafka clients send their first request right away) is kept,
+// to be forwarded once the broker connection is open
+type clientWatch struct {
+	conn net.Conn
+	buf  []byte
+	n    int
+	err  error
+	done chan struct{}
+}
+
+// Starts watching conn, calling cancel if reading from it fails
+func watchClient(conn net.Conn, bufSize int, cancel context.CancelFunc) *clientWatch {
+	w := &clientWatch{conn: conn, buf: make([]byte, bufSize), done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		w.n, w.err = conn.Read(w.buf)
+		if w.err != nil {
+			cancel()
+		}
+	}()
+	return w
+}
+
+// Stops watching, and returns the data read from the client, or the error if
+// the client disconnected
+func (w *clientWatch) stop() ([]byte, error) {
+	select {
+	case <-w.done:
+	default:
+		// Unblocks the read, which times out without anything being wrong
+		// with the client
+		w.conn.SetReadDeadline(time.Now())
+		<-w.done
+		var netErr net.Error
+		if errors.As(w.err, &netErr) && netErr.Timeout() {
+			w.err = nil
+		}
+	}
+	if err := w.conn.SetReadDeadline(time.Time{}); err != nil && w.err == nil {
+		w.err = err
+	}
+	return w.buf[:w.n], w.err
+}
+
 // Open a WebSocket connection with the broker, using exponential backoff if the
 // connection fails. When running the broker in local mode using Docker Compose,
 // the broker takes 1-2 seconds to become ready after the container is created,
 // and this backoff gives it plenty of time to become ready
-func dialBroker(ctx context.Context, dialer proxy.ContextDialer) (net.Conn, error) {
+func dialBroker(ctx context.Context, dialer proxy.ContextDialer, brokerAddr string, connLogger *slog.Logger) (_ net.Conn, err error) {
+	ctx, span := connTracer.Start(ctx, "proxy.dial_broker")
+	defer func() { span.End(err) }()
+	attempts := dialBrokerRetries
+	if *reconnectBroker {
+		// The dialer does the retries
+		attempts = 1
+	}
 	var dialErr error
-	wait := dialBrokerWait
-	for i := 0; i < dialBrokerRetries; i++ {
-		if ws, err := dialer.DialContext(ctx, "tcp", *broker); err != nil {
-			if i < dialBrokerRetries-1 {
+	for i := 0; i < attempts; i++ {
+		if ws, err := dialAttempt(ctx, dialer, brokerAddr, i); err != nil {
+			metrics.dialFailures.add(strconv.Itoa(i), 1)
+			connLogger.Debug("dial broker failed", "broker", brokerAddr, "retries", i, "error", err)
+			span.AddEvent("dial failed", slog.Int("retries", i), slog.String("error", err.Error()))
+			if i < attempts-1 {
 				// Don't sleep on the final iteration, because
 				// dialer.DialContext won't be called again
-				time.Sleep(wait)
-				wait *= dialBrokerBackoff
+				t := time.NewTimer(backoffWait(*dialBackoff, *dialBackoffMultiplier, *dialBackoffJitter, i, rand.Float64()))
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					// Shutting down, so don't keep the client waiting
+					t.Stop()
+					return nil, ctx.Err()
+				}
 			}
 			dialErr = err
 		} else {
+			metrics.recordDial()
 			return ws, nil
 		}
 	}
 	return nil, dialErr
 }
 
-func pipeFunc(ctx context.Context, src net.Conn, dst net.Conn) func() error {
+// Dials the broker once, which opens the connection and does the WebSocket
+// handshake, in a span of its own
+func dialAttempt(ctx context.Context, dialer proxy.ContextDialer, brokerAddr string, retries int) (_ net.Conn, err error) {
+	ctx, span := connTracer.Start(ctx, "proxy.handshake")
+	span.SetAttributes(slog.Int("retries", retries))
+	defer func() { span.End(err) }()
+	return dialer.DialContext(ctx, "tcp", brokerAddr)
+}
+
+// Returns how long to wait after the given failed dial attempt (starting from
+// zero), which grows exponentially from base. The wait is reduced by a random
+// fraction of up to jitter, using r from [0, 1), so that clients that lost
+// their connections at the same time (like when the broker restarts) don't
+// retry in lockstep
+func backoffWait(base time.Duration, multiplier float64, jitter float64, attempt int, r float64) time.Duration {
+	wait := float64(base)
+	for i := 0; i < attempt; i++ {
+		wait *= multiplier
+	}
+	return time.Duration(wait * (1 - jitter*r))
+}
+
+// Logs the time spent in each phase of a broker dial, and adds it to the dial
+// phase metrics
+func recordDialTiming(brokerAddr string, t shim.DialTiming, err error) {
+	phases := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"dns", t.DNS},
+		{"connect", t.Connect},
+		{"tls_handshake", t.TLSHandshake},
+		{"upgrade", t.Upgrade},
+	}
+	for _, p := range phases {
+		metrics.dialPhaseSeconds.add(p.name, p.d.Seconds())
+	}
+	logger.Info("traced broker dial", "broker", brokerAddr, "dns", t.DNS, "connect", t.Connect,
+		"tls_handshake", t.TLSHandshake, "upgrade", t.Upgrade, "total", t.Total, "error", err)
+}
+
+// Checks that the pipe buffer size is positive, and small enough that a burst
+// of connections can't exhaust memory
+func validateBufSize(n int) error {
+	if n <= 0 || n > maxPipeBufSize {
+		return errors.Errorf("buf-size must be between 1 and %d but got %d", maxPipeBufSize, n)
+	}
+	return nil
+}
+
+// Deadlines applied before each read and write by pipe, which are pushed back
+// on every operation so that only stuck connections time out. Zero disables
+// the deadline
+type pipeTimeouts struct {
+	read  time.Duration
+	write time.Duration
+}
+
+// If piped is not nil, the number of bytes written to dst is added to it. If
+// observe is not nil, it is called with all data that is piped successfully.
+// Cancelling ctx unblocks a read from src that is waiting on a silent peer, so
+// the pipe returns promptly even if nothing closes src
+func pipeFunc(ctx context.Context, src net.Conn, dst net.Conn, bufSize int, timeouts pipeTimeouts, piped *atomic.Int64, observe func([]byte)) func() error {
 	return func() error {
-		buf := make([]byte, pipeBufSize)
+		c := &cancelConn{Conn: src}
+		stop := context.AfterFunc(ctx, c.cancel)
+		defer stop()
+		buf := make([]byte, bufSize)
 		for {
-			if _, err := pipe(src, dst, buf); err != nil {
+			n, err := pipe(c, dst, buf, timeouts, observe)
+			if piped != nil {
+				piped.Add(int64(n))
+			}
+			if err != nil {
 				select {
 				case <-ctx.Done():
 					return nil
@@ -159,14 +715,54 @@ func pipeFunc(ctx context.Context, src net.Conn, dst net.Conn) func() error {
 	}
 }
 
-func pipe(src net.Conn, dst net.Conn, buf []byte) (int, error) {
+// Expires the read deadline of a connection once cancelled, and keeps it
+// expired, so that the read timeout set before the next read can't undo a
+// cancellation that lands just before it
+type cancelConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	cancelled bool
+}
+
+func (c *cancelConn) cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelled = true
+	c.Conn.SetReadDeadline(time.Now())
+}
+
+func (c *cancelConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancelled {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func pipe(src net.Conn, dst net.Conn, buf []byte, timeouts pipeTimeouts, observe func([]byte)) (int, error) {
+	if timeouts.read > 0 {
+		if err := src.SetReadDeadline(time.Now().Add(timeouts.read)); err != nil {
+			return 0, err
+		}
+	}
 	n, err := src.Read(buf)
 	if err != nil {
 		return 0, err
 	}
+	read := n
+	if timeouts.write > 0 {
+		if err := dst.SetWriteDeadline(time.Now().Add(timeouts.write)); err != nil {
+			return 0, err
+		}
+	}
 	n, err = dst.Write(buf[:n])
 	if err != nil {
 		return n, err
 	}
+	if observe != nil {
+		observe(buf[:read])
+	}
 	return n, nil
 }
@@ -0,0 +1,972 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/maxwellpeterson/kafka-websocket-shim/pkg/shim"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	mainEnv = "KAFKA_WEBSOCKET_PROXY_MAIN"
+)
+
+// When the test binary is started with mainEnv set, it runs the proxy instead
+// of the tests, so tests can exercise main (flags, signals, exit codes) in a
+// subprocess
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Starts the proxy in a subprocess with the given flags
+func StartProxy(t *testing.T, args ...string) *exec.Cmd {
+	return StartProxyLogs(t, os.Stderr, args...)
+}
+
+// Starts the proxy in a subprocess with the given flags, writing its logs to
+// logs instead of the test output
+func StartProxyLogs(t *testing.T, logs io.Writer, args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), mainEnv+"=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = logs
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+// Waits for the proxy subprocess to exit, failing the test if it doesn't exit
+// within the timeout
+func WaitProxy(t *testing.T, cmd *exec.Cmd, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		t.Fatal("proxy did not exit in time")
+		return nil
+	}
+}
+
+// Returns a port that is free at the time of the call
+func FreePort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// Starts a stub broker that accepts WebSocket connections and echoes every
+// message back. Returns the host:port address of the broker
+func StartBroker(t *testing.T) (string, func()) {
+	return StartBrokerHandler(t, func(c *websocket.Conn) {
+		for {
+			mt, p, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(mt, p); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// Starts a stub broker that echoes the first message back, then closes the
+// connection normally
+func StartClosingBroker(t *testing.T) (string, func()) {
+	return StartBrokerHandler(t, func(c *websocket.Conn) {
+		mt, p, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := c.WriteMessage(mt, p); err != nil {
+			return
+		}
+		c.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		// Wait for the proxy to reply to the close message
+		c.ReadMessage()
+	})
+}
+
+// Starts a stub broker that serves each WebSocket connection with handler
+func StartBrokerHandler(t *testing.T, handler func(c *websocket.Conn)) (string, func()) {
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		handler(c)
+	}))
+	return strings.TrimPrefix(s.URL, "http://"), s.Close
+}
+
+// Returns the body of a GET request, or the empty string if it failed
+func Scrape(url string) string {
+	resp, err := http.Get(url)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ""
+	}
+	return string(body)
+}
+
+func Get(url string) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// Connects to the proxy, retrying until it is listening
+func Connect(t *testing.T, port string) net.Conn {
+	var conn net.Conn
+	assert.Eventually(t, func() bool {
+		c, err := net.Dial("tcp", "localhost:"+port)
+		conn = c
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "proxy accepts connections")
+	return conn
+}
+
+// Sends a Kafka protocol message through the proxy, and reads the echo from
+// the stub broker
+func RoundTrip(conn net.Conn) error {
+	msg := []byte{0, 0, 0, 4, 'k', 'a', 'f', 'k'}
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(conn, make([]byte, len(msg)))
+	return err
+}
+
+func TestHealthShutdown(t *testing.T) {
+	// Stands in for the broker, since readiness only needs a TCP dial
+	broker, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	defer broker.Close()
+
+	healthPort := FreePort(t)
+	cmd := StartProxy(t,
+		"-port", FreePort(t),
+		"-broker", broker.Addr().String(),
+		"-health-port", healthPort,
+		"-shutdown-delay", "2s",
+	)
+	healthz := "http://localhost:" + healthPort + "/healthz"
+	readyz := "http://localhost:" + healthPort + "/readyz"
+
+	assert.Eventually(t, func() bool {
+		return Get(readyz) == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond, "ready before shutdown")
+	assert.Equal(t, http.StatusOK, Get(healthz), "alive before shutdown")
+
+	assert.Nil(t, cmd.Process.Signal(syscall.SIGTERM))
+	assert.Eventually(t, func() bool {
+		return Get(readyz) == http.StatusServiceUnavailable
+	}, time.Second, 10*time.Millisecond, "not ready during shutdown")
+	assert.Equal(t, http.StatusOK, Get(healthz), "alive during shutdown")
+
+	assert.Nil(t, WaitProxy(t, cmd, 5*time.Second), "clean exit after shutdown")
+}
+
+func TestMetrics(t *testing.T) {
+	broker, stop := StartBroker(t)
+	defer stop()
+
+	port := FreePort(t)
+	metricsPort := FreePort(t)
+	cmd := StartProxy(t,
+		"-port", port,
+		"-broker", broker,
+		"-metrics-port", metricsPort,
+	)
+	defer WaitProxy(t, cmd, 5*time.Second)
+	defer cmd.Process.Signal(syscall.SIGTERM)
+	url := "http://localhost:" + metricsPort + "/metrics"
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(Scrape(url), "kafka_proxy_active_connections 0\n")
+	}, 5*time.Second, 10*time.Millisecond, "no connections before client connects")
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(Scrape(url), "kafka_proxy_active_connections 1\n")
+	}, 5*time.Second, 10*time.Millisecond, "connection gauge increments when client connects")
+
+	// The stub broker echoes the message, so it is piped in both directions
+	msg := []byte{0, 0, 0, 4, 'k', 'a', 'f', 'k'}
+	_, err = conn.Write(msg)
+	assert.Nil(t, err)
+	_, err = io.ReadFull(conn, make([]byte, len(msg)))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		body := Scrape(url)
+		return strings.Contains(body, `kafka_proxy_bytes_piped_total{direction="upstream"} 8`) &&
+			strings.Contains(body, `kafka_proxy_bytes_piped_total{direction="downstream"} 8`)
+	}, 5*time.Second, 10*time.Millisecond, "bytes piped are counted in both directions")
+
+	assert.Nil(t, conn.Close())
+	assert.Eventually(t, func() bool {
+		return strings.Contains(Scrape(url), "kafka_proxy_active_connections 0\n")
+	}, 5*time.Second, 10*time.Millisecond, "connection gauge decrements when client disconnects")
+}
+
+func TestDrain(t *testing.T) {
+	broker, stop := StartBroker(t)
+	defer stop()
+
+	port := FreePort(t)
+	cmd := StartProxy(t,
+		"-port", port,
+		"-broker", broker,
+		"-drain-timeout", "500ms",
+	)
+	conn := Connect(t, port)
+	defer conn.Close()
+	assert.Nil(t, RoundTrip(conn), "round trip before shutdown")
+
+	start := time.Now()
+	assert.Nil(t, cmd.Process.Signal(syscall.SIGTERM))
+	assert.Nil(t, RoundTrip(conn), "open connection keeps working while draining")
+
+	// The connection is still open, so it is force closed after the timeout
+	assert.Nil(t, WaitProxy(t, cmd, 5*time.Second), "clean exit after drain")
+	assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond, "waits for drain timeout")
+	assert.Less(t, time.Since(start), 2*time.Second, "exits soon after drain timeout")
+	_, err := conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "connection closed by proxy")
+}
+
+func TestMaxConnsReject(t *testing.T) {
+	broker, stop := StartBroker(t)
+	defer stop()
+
+	port := FreePort(t)
+	cmd := StartProxy(t, "-port", port, "-broker", broker, "-max-conns", "1")
+	defer WaitProxy(t, cmd, 5*time.Second)
+	defer cmd.Process.Signal(syscall.SIGTERM)
+
+	first := Connect(t, port)
+	defer first.Close()
+	assert.Nil(t, RoundTrip(first), "first connection is served")
+
+	second := Connect(t, port)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := second.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "second connection is refused")
+
+	// Closing the first connection frees its slot
+	assert.Nil(t, first.Close())
+	assert.Eventually(t, func() bool {
+		third, err := net.Dial("tcp", "localhost:"+port)
+		if err != nil {
+			return false
+		}
+		defer third.Close()
+		third.SetDeadline(time.Now().Add(time.Second))
+		return RoundTrip(third) == nil
+	}, 5*time.Second, 50*time.Millisecond, "slot is freed when first connection closes")
+}
+
+func TestMaxConnsBlock(t *testing.T) {
+	broker, stop := StartBroker(t)
+	defer stop()
+
+	port := FreePort(t)
+	cmd := StartProxy(t, "-port", port, "-broker", broker, "-max-conns", "1", "-max-conns-policy", "block")
+	defer WaitProxy(t, cmd, 5*time.Second)
+	defer cmd.Process.Signal(syscall.SIGTERM)
+
+	first := Connect(t, port)
+	defer first.Close()
+	assert.Nil(t, RoundTrip(first), "first connection is served")
+
+	// The second connection waits in the backlog until the first closes
+	second := Connect(t, port)
+	defer second.Close()
+	done := make(chan error, 1)
+	go func() { done <- RoundTrip(second) }()
+	select {
+	case <-done:
+		t.Fatal("second connection served while first is open")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	assert.Nil(t, first.Close())
+	select {
+	case err := <-done:
+		assert.Nil(t, err, "second connection served after first closes")
+	case <-time.After(5 * time.Second):
+		t.Fatal("second connection not served after first closed")
+	}
+}
+
+func TestBrokerClose(t *testing.T) {
+	broker, stop := StartClosingBroker(t)
+	defer stop()
+
+	var logs bytes.Buffer
+	port := FreePort(t)
+	cmd := StartProxyLogs(t, &logs, "-port", port, "-broker", broker, "-log-format", "json")
+
+	conn := Connect(t, port)
+	defer conn.Close()
+	assert.Nil(t, RoundTrip(conn))
+	// The proxy closes the client connection once the broker closes
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	assert.Nil(t, cmd.Process.Signal(syscall.SIGTERM))
+	assert.Nil(t, WaitProxy(t, cmd, 5*time.Second))
+
+	assert.Len(t, FindLogs(t, &logs, "closed tcp connection"), 1)
+	assert.Empty(t, FindLogs(t, &logs, "connection failed"))
+}
+
+func TestReconnectBroker(t *testing.T) {
+	var conns atomic.Int32
+	reconnected := make(chan struct{})
+	broker, stop := StartBrokerHandler(t, func(c *websocket.Conn) {
+		if conns.Add(1) == 1 {
+			// Answers the first request, then drops the connection without
+			// a close message
+			mt, p, err := c.ReadMessage()
+			if err == nil {
+				c.WriteMessage(mt, p)
+			}
+			c.UnderlyingConn().Close()
+			return
+		}
+		close(reconnected)
+		for {
+			mt, p, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(mt, p); err != nil {
+				return
+			}
+		}
+	})
+	defer stop()
+
+	var logs bytes.Buffer
+	port := FreePort(t)
+	cmd := StartProxyLogs(t, &logs, "-port", port, "-broker", broker, "-reconnect-broker", "-log-format", "json")
+
+	conn := Connect(t, port)
+	defer conn.Close()
+	assert.Nil(t, RoundTrip(conn))
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy didn't reconnect to the broker")
+	}
+	// The client connection survives the broker dropping
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	assert.Nil(t, RoundTrip(conn))
+
+	assert.Nil(t, cmd.Process.Signal(syscall.SIGTERM))
+	assert.Nil(t, WaitProxy(t, cmd, 5*time.Second))
+	assert.Equal(t, int32(2), conns.Load())
+	assert.Len(t, FindLogs(t, &logs, "opened websocket connection"), 1)
+	assert.Empty(t, FindLogs(t, &logs, "connection failed"))
+}
+
+func TestRewriteMetadataFlag(t *testing.T) {
+	// Answers every request with the same Metadata v1 response
+	broker, stop := StartBrokerHandler(t, func(c *websocket.Conn) {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+			resp := MakeKafkaMsg(int32(5), int32(1), int32(0), KafkaString("kafka-0.internal"), int32(9092), int16(-1), int32(0))
+			if err := c.WriteMessage(websocket.BinaryMessage, resp); err != nil {
+				return
+			}
+		}
+	})
+	defer stop()
+
+	port := FreePort(t)
+	cmd := StartProxy(t, "-port", port, "-broker", broker, "-rewrite-metadata", "-advertise-host", "proxy.local")
+
+	conn := Connect(t, port)
+	defer conn.Close()
+	_, err := conn.Write(MakeKafkaMsg(int16(3), int16(1), int32(5), int16(-1), int32(-1)))
+	assert.Nil(t, err)
+	p, _ := strconv.Atoi(port)
+	want := MakeKafkaMsg(int32(5), int32(1), int32(0), KafkaString("proxy.local"), int32(p), int16(-1), int32(0))
+	got := make([]byte, len(want))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, got)
+	assert.Nil(t, err)
+	assert.Equal(t, want, got)
+
+	assert.Nil(t, cmd.Process.Signal(syscall.SIGTERM))
+	assert.Nil(t, WaitProxy(t, cmd, 5*time.Second))
+}
+
+func TestUnixListener(t *testing.T) {
+	broker, stop := StartBroker(t)
+	defer stop()
+
+	sock := filepath.Join(t.TempDir(), "proxy.sock")
+	cmd := StartProxy(t, "-listen", "unix://"+sock, "-broker", broker)
+
+	var conn net.Conn
+	assert.Eventually(t, func() bool {
+		c, err := net.Dial("unix", sock)
+		conn = c
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "proxy accepts connections")
+	if conn == nil {
+		cmd.Process.Kill()
+		return
+	}
+	defer conn.Close()
+	assert.Nil(t, RoundTrip(conn))
+	assert.Nil(t, conn.Close())
+
+	assert.Nil(t, cmd.Process.Signal(syscall.SIGTERM))
+	assert.Nil(t, WaitProxy(t, cmd, 5*time.Second))
+	_, err := os.Stat(sock)
+	assert.True(t, os.IsNotExist(err), "socket file is removed on shutdown")
+}
+
+// Writes a self-signed certificate for localhost and its key to temporary
+// files, and returns their paths along with a pool that trusts the certificate
+func WriteCert(t *testing.T) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestListenerTLS(t *testing.T) {
+	broker, stop := StartBroker(t)
+	defer stop()
+
+	certFile, keyFile, pool := WriteCert(t)
+	port := FreePort(t)
+	cmd := StartProxy(t, "-port", port, "-broker", broker, "-tls-cert", certFile, "-tls-key", keyFile)
+	defer WaitProxy(t, cmd, 5*time.Second)
+	defer cmd.Process.Signal(syscall.SIGTERM)
+
+	var conn net.Conn
+	assert.Eventually(t, func() bool {
+		c, err := cryptotls.Dial("tcp", "localhost:"+port, &cryptotls.Config{RootCAs: pool})
+		if err != nil {
+			return false
+		}
+		conn = c
+		return true
+	}, 5*time.Second, 10*time.Millisecond, "proxy accepts tls connections")
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	assert.Nil(t, RoundTrip(conn), "round trip over tls")
+}
+
+func TestListenerTLSSlowHandshake(t *testing.T) {
+	broker, stop := StartBroker(t)
+	defer stop()
+
+	certFile, keyFile, pool := WriteCert(t)
+	port := FreePort(t)
+	cmd := StartProxy(t, "-port", port, "-broker", broker, "-tls-cert", certFile, "-tls-key", keyFile)
+	defer WaitProxy(t, cmd, 5*time.Second)
+	defer cmd.Process.Signal(syscall.SIGTERM)
+
+	// The broker is dialed before the client starts the handshake
+	raw := Connect(t, port)
+	defer raw.Close()
+	time.Sleep(100 * time.Millisecond)
+	conn := cryptotls.Client(raw, &cryptotls.Config{RootCAs: pool, ServerName: "localhost"})
+	assert.Nil(t, RoundTrip(conn), "round trip over tls")
+}
+
+func TestListenerTLSFlags(t *testing.T) {
+	certFile, _, _ := WriteCert(t)
+	cmd := StartProxy(t, "-port", FreePort(t), "-tls-cert", certFile)
+	err := WaitProxy(t, cmd, 5*time.Second)
+	var exitErr *exec.ExitError
+	assert.True(t, errors.As(err, &exitErr), "proxy fails to start without -tls-key")
+}
+
+func TestForwardedFor(t *testing.T) {
+	forwarded := make(chan string, 1)
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Get("X-Forwarded-For")
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c.Close()
+	}))
+	defer s.Close()
+
+	client, server := TCPPair(t)
+	defer client.Close()
+	go handleClient(context.Background(), server, shim.NewDialer(shim.DialerConfig{}),
+		strings.TrimPrefix(s.URL, "http://"), logger)
+
+	host, _, err := net.SplitHostPort(client.LocalAddr().String())
+	assert.Nil(t, err)
+	select {
+	case got := <-forwarded:
+		assert.Equal(t, host, got, "broker sees the client address")
+	case <-time.After(5 * time.Second):
+		t.Fatal("broker was not dialed")
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	broker, stop := StartBroker(t)
+	defer stop()
+
+	var logs bytes.Buffer
+	port := FreePort(t)
+	cmd := StartProxyLogs(t, &logs, "-port", port, "-broker", broker, "-log-format", "json", "-read-timeout", "200ms")
+
+	conn := Connect(t, port)
+	defer conn.Close()
+	assert.Nil(t, RoundTrip(conn))
+	// The client goes idle, so the proxy closes the connection
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	assert.Nil(t, cmd.Process.Signal(syscall.SIGTERM))
+	assert.Nil(t, WaitProxy(t, cmd, 5*time.Second))
+
+	assert.Len(t, FindLogs(t, &logs, "connection timed out"), 1)
+	assert.Empty(t, FindLogs(t, &logs, "connection failed"))
+}
+
+// Starts a stub broker that replies to every message with a one byte message
+// containing id, so that tests can tell brokers apart
+func StartIDBroker(t *testing.T, id byte) (string, func()) {
+	return StartBrokerHandler(t, func(c *websocket.Conn) {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+			if err := c.WriteMessage(websocket.BinaryMessage, []byte{0, 0, 0, 1, id}); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestMultipleListeners(t *testing.T) {
+	brokerA, stopA := StartIDBroker(t, 'a')
+	defer stopA()
+	brokerB, stopB := StartIDBroker(t, 'b')
+	defer stopB()
+
+	portA, portB := FreePort(t), FreePort(t)
+	cmd := StartProxy(t, "-port", portA+","+portB, "-broker", brokerA+","+brokerB)
+	defer WaitProxy(t, cmd, 5*time.Second)
+	defer cmd.Process.Signal(syscall.SIGTERM)
+
+	for port, id := range map[string]byte{portA: 'a', portB: 'b'} {
+		conn := Connect(t, port)
+		if conn == nil {
+			return
+		}
+		_, err := conn.Write([]byte{0, 0, 0, 1, 'k'})
+		assert.Nil(t, err)
+		resp := make([]byte, 5)
+		_, err = io.ReadFull(conn, resp)
+		assert.Nil(t, err)
+		assert.Equal(t, id, resp[4], "listener forwards to its own broker")
+		conn.Close()
+	}
+}
+
+func TestListenBrokers(t *testing.T) {
+	addrs, brokers, err := listenBrokers("", "9001,9002", "b:1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{":9001", ":9002"}, addrs)
+	assert.Equal(t, []string{"b:1", "b:1"}, brokers, "single broker is shared")
+
+	addrs, brokers, err = listenBrokers("unix:///tmp/a.sock,:9003", "9001", "b:1,b:2")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"unix:///tmp/a.sock", ":9003"}, addrs)
+	assert.Equal(t, []string{"b:1", "b:2"}, brokers)
+
+	_, _, err = listenBrokers("", "9001,9002", "b:1,b:2,b:3")
+	assert.EqualError(t, err, "got 3 brokers for 2 listen addresses")
+
+	_, brokers, err = listenBrokers("", "9001,9002", "[::1]:8787,[fe80::1%eth0]:8787")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"[::1]:8787", "[fe80::1%eth0]:8787"}, brokers, "ipv6 brokers keep their brackets")
+
+	_, _, err = listenBrokers("", "9001", "::1:8787")
+	assert.ErrorContains(t, err, `invalid broker address "::1:8787"`, "ipv6 brokers need brackets")
+	_, _, err = listenBrokers("", "9001", "b:1,localhost")
+	assert.ErrorContains(t, err, `invalid broker address "localhost"`, "brokers need a port")
+}
+
+func TestValidateBroker(t *testing.T) {
+	for _, addr := range []string{"localhost:8787", "mybroker.workers.dev:443", "[::1]:8787", "10.0.0.1:9092"} {
+		assert.Nil(t, validateBroker(addr), addr)
+	}
+	for addr, msg := range map[string]string{
+		"":                     "missing broker address",
+		"localhost":            `invalid broker address "localhost": missing port in address`,
+		"::1:8787":             `invalid broker address "::1:8787": too many colons in address`,
+		":8787":                `invalid broker address ":8787": missing host`,
+		"localhost:kafka":      `invalid broker address "localhost:kafka": invalid port "kafka"`,
+		"localhost:70000":      `invalid broker address "localhost:70000": invalid port "70000"`,
+		"ws://localhost:8787/": `invalid broker address "ws://localhost:8787/": too many colons in address`,
+	} {
+		err := validateBroker(addr)
+		assert.ErrorContains(t, err, msg, addr)
+		assert.ErrorContains(t, err, "expected host:port, such as mybroker.workers.dev:443", "error shows an example")
+	}
+}
+
+func TestInvalidBrokerFlag(t *testing.T) {
+	var logs bytes.Buffer
+	cmd := StartProxyLogs(t, &logs, "-port", FreePort(t), "-broker", "mybroker.workers.dev")
+	err := WaitProxy(t, cmd, 5*time.Second)
+	var exitErr *exec.ExitError
+	assert.ErrorAs(t, err, &exitErr, "proxy exits at startup")
+	assert.Contains(t, logs.String(), `invalid broker address \"mybroker.workers.dev\": missing port in address`)
+	assert.Contains(t, logs.String(), "such as mybroker.workers.dev:443")
+}
+
+func TestBackoffWait(t *testing.T) {
+	base := 200 * time.Millisecond
+	for attempt := 0; attempt < dialBrokerRetries; attempt++ {
+		max := base << attempt
+		// Covers the range of random fractions
+		for i := 0; i < 100; i++ {
+			r := float64(i) / 100
+			wait := backoffWait(base, 2, 1, attempt, r)
+			assert.Greater(t, wait, time.Duration(0))
+			assert.LessOrEqual(t, wait, max, "full jitter waits up to the exponential backoff")
+
+			wait = backoffWait(base, 2, 0.5, attempt, r)
+			assert.Greater(t, wait, max/2, "partial jitter keeps part of the wait")
+			assert.LessOrEqual(t, wait, max)
+		}
+		assert.Equal(t, max, backoffWait(base, 2, 0, attempt, 0.5), "no jitter waits exactly")
+	}
+}
+
+// Fails every dial
+type FailingDialer struct{}
+
+func (FailingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, errors.New("dial failed")
+}
+
+func TestDialBrokerCancel(t *testing.T) {
+	defer func(d time.Duration, j float64) { *dialBackoff, *dialBackoffJitter = d, j }(*dialBackoff, *dialBackoffJitter)
+	*dialBackoff, *dialBackoffJitter = time.Minute, 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := dialBroker(ctx, FailingDialer{}, "localhost:8787", logger)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 5*time.Second, "backoff ends when the context is cancelled")
+}
+
+// Starts a stub broker like StartIDBroker, listening on the given address.
+// Returns the port the broker listens on
+func StartIDBrokerAt(t *testing.T, addr string, id byte) (string, func(), error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", nil, err
+	}
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+			if err := c.WriteMessage(websocket.BinaryMessage, []byte{0, 0, 0, 1, id}); err != nil {
+				return
+			}
+		}
+	}))
+	s.Listener.Close()
+	s.Listener = l
+	s.Start()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port), s.Close, nil
+}
+
+func TestDialBrokerResolvesPerDial(t *testing.T) {
+	port, stopA, err := StartIDBrokerAt(t, "127.0.0.1:0", 'a')
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer stopA()
+	// Listens on the same port at another loopback address, as if the
+	// broker's DNS name moved to a new IP
+	_, stopB, err := StartIDBrokerAt(t, "127.0.0.2:"+port, 'b')
+	if err != nil {
+		t.Skipf("127.0.0.2 unavailable: %v", err)
+	}
+	defer stopB()
+
+	// Each lookup returns the next address, like DNS records that rotate
+	ips := []string{"127.0.0.1", "127.0.0.2"}
+	lookups := 0
+	dialer := shim.NewDialer(shim.DialerConfig{
+		LookupHost: func(ctx context.Context, host string) ([]string, error) {
+			ip := ips[lookups%len(ips)]
+			lookups++
+			return []string{ip}, nil
+		},
+	})
+	for _, id := range []byte{'a', 'b'} {
+		ws, err := dialBroker(context.Background(), dialer, "broker.invalid:"+port, logger)
+		if !assert.Nil(t, err) {
+			return
+		}
+		_, err = ws.Write([]byte{0, 0, 0, 1, 'k'})
+		assert.Nil(t, err)
+		resp := make([]byte, 5)
+		_, err = io.ReadFull(ws, resp)
+		assert.Nil(t, err)
+		assert.Equal(t, id, resp[4], "each dial resolves the broker again")
+		ws.Close()
+	}
+}
+
+func TestVersionFlag(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-version")
+	cmd.Env = append(os.Environ(), mainEnv+"=1")
+	out, err := cmd.Output()
+	assert.Nil(t, err, "proxy exits zero")
+	assert.Equal(t, shim.Version+"\n", string(out))
+}
+
+func TestProbe(t *testing.T) {
+	broker, stop := StartBroker(t)
+	defer stop()
+
+	cmd := exec.Command(os.Args[0], "-probe", "-broker", broker)
+	cmd.Env = append(os.Environ(), mainEnv+"=1")
+	out, err := cmd.Output()
+	assert.Nil(t, err, "proxy exits zero")
+	assert.True(t, strings.HasPrefix(string(out), "OK "+broker+" "), "reports success: %s", out)
+	assert.Contains(t, string(out), "url=ws://"+broker)
+	assert.Contains(t, string(out), "status=101")
+	assert.Contains(t, string(out), "subprotocol=none")
+	assert.Contains(t, string(out), "time=")
+}
+
+func TestProbeFailure(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer s.Close()
+	broker := strings.TrimPrefix(s.URL, "http://")
+
+	cmd := exec.Command(os.Args[0], "-probe", "-broker", broker)
+	cmd.Env = append(os.Environ(), mainEnv+"=1")
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if assert.ErrorAs(t, err, &exitErr, "proxy exits non-zero") {
+		assert.Equal(t, 1, exitErr.ExitCode())
+	}
+	assert.True(t, strings.HasPrefix(string(out), "FAIL "+broker+" "), "reports failure: %s", out)
+	assert.Contains(t, string(out), "status=403")
+}
+
+func TestRandomPort(t *testing.T) {
+	broker, stop := StartBroker(t)
+	defer stop()
+
+	r, w := io.Pipe()
+	cmd := StartProxyLogs(t, w, "-port", "0", "-broker", broker, "-log-format", "json")
+	defer w.Close()
+
+	// The port is only known once the proxy reports it
+	var port float64
+	dec := json.NewDecoder(r)
+	for {
+		var record map[string]interface{}
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		if record["msg"] == "listening for connections" {
+			port, _ = record["port"].(float64)
+			assert.NotZero(t, port, "the assigned port is reported")
+			break
+		}
+	}
+	go io.Copy(io.Discard, r)
+
+	conn := Connect(t, strconv.Itoa(int(port)))
+	defer conn.Close()
+	assert.Nil(t, RoundTrip(conn))
+
+	assert.Nil(t, cmd.Process.Signal(syscall.SIGTERM))
+	assert.Nil(t, WaitProxy(t, cmd, 5*time.Second))
+}
+
+func TestDialTimeout(t *testing.T) {
+	var logs bytes.Buffer
+	port := FreePort(t)
+	// Nothing listens on the broker port, and the backoff alone would keep the
+	// client waiting for seconds
+	cmd := StartProxyLogs(t, &logs, "-port", port, "-broker", "localhost:"+FreePort(t), "-log-format", "json",
+		"-dial-timeout", "300ms", "-dial-backoff", "1s", "-dial-backoff-jitter", "0")
+
+	conn := Connect(t, port)
+	defer conn.Close()
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "client is dropped")
+	assert.Less(t, time.Since(start), time.Second)
+
+	assert.Nil(t, cmd.Process.Signal(syscall.SIGTERM))
+	assert.Nil(t, WaitProxy(t, cmd, 5*time.Second))
+
+	records := FindLogs(t, &logs, "connection failed")
+	assert.Len(t, records, 1)
+	if len(records) == 1 {
+		assert.Contains(t, records[0]["error"], "dial broker timed out after 300ms")
+	}
+}
+
+func TestHandshakeStatusLogs(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "missing token", http.StatusUnauthorized)
+	}))
+	defer s.Close()
+
+	var logs bytes.Buffer
+	port := FreePort(t)
+	cmd := StartProxyLogs(t, &logs, "-port", port, "-broker", strings.TrimPrefix(s.URL, "http://"),
+		"-log-format", "json", "-dial-backoff", "1ms")
+
+	conn := Connect(t, port)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "client is dropped")
+
+	assert.Nil(t, cmd.Process.Signal(syscall.SIGTERM))
+	assert.Nil(t, WaitProxy(t, cmd, 5*time.Second))
+
+	records := FindLogs(t, &logs, "broker rejected websocket upgrade")
+	assert.Len(t, records, 1)
+	if len(records) == 1 {
+		assert.Equal(t, float64(http.StatusUnauthorized), records[0]["status"])
+		assert.NotEmpty(t, records[0]["remote_addr"], "logged for the client")
+	}
+}
+
+func TestClientClosedDuringDial(t *testing.T) {
+	defer func(d time.Duration, j float64) { *dialBackoff, *dialBackoffJitter = d, j }(*dialBackoff, *dialBackoffJitter)
+	*dialBackoff, *dialBackoffJitter = time.Minute, 0
+
+	var logs bytes.Buffer
+	l, err := newLogger(&logs, "info", "json")
+	assert.Nil(t, err)
+
+	client, server := TCPPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- handleClient(context.Background(), server, FailingDialer{}, "localhost:8787", l)
+	}()
+	// The client gives up while the proxy is waiting to retry the dial
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, client.Close())
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial kept retrying after the client closed")
+	}
+	assert.Len(t, FindLogs(t, &logs, "client closed during broker dial"), 1)
+}
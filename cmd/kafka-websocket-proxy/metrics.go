@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	counter = "counter"
+	gauge   = "gauge"
+)
+
+// A metric with at most one label, which is all the proxy needs. Metrics are
+// exposed in the Prometheus text format, which keeps the proxy free of a
+// metrics client dependency
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// Adds v to the metric value for the given label value. Metrics without a label
+// use the empty string
+func (m *metric) add(labelValue string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[labelValue] += v
+}
+
+// Returns the metric value for the given label value
+func (m *metric) value(labelValue string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[labelValue]
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	if m.label == "" {
+		fmt.Fprintf(w, "%s %v\n", m.name, m.values[""])
+		return
+	}
+	labelValues := make([]string, 0, len(m.values))
+	for lv := range m.values {
+		labelValues = append(labelValues, lv)
+	}
+	sort.Strings(labelValues)
+	for _, lv := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%s} %v\n", m.name, m.label, strconv.Quote(lv), m.values[lv])
+	}
+}
+
+// A set of metrics that can be served over HTTP
+type registry struct {
+	metrics []*metric
+}
+
+func (r *registry) newMetric(name, help, kind, label string) *metric {
+	m := &metric{name: name, help: help, kind: kind, label: label, values: make(map[string]float64)}
+	if label == "" {
+		// Report unlabeled metrics even before they are first updated
+		m.values[""] = 0
+	}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
+
+// The metrics reported by the proxy
+type proxyMetrics struct {
+	registry *registry
+
+	activeConns  *metric
+	bytesPiped   *metric
+	dialFailures *metric
+	throttleMs   *metric
+
+	dialPhaseSeconds *metric
+
+	// Unix time in nanoseconds of the last successful broker dial, or zero if
+	// there hasn't been one yet
+	lastDial atomic.Int64
+}
+
+func (m *proxyMetrics) recordDial() {
+	m.lastDial.Store(time.Now().UnixNano())
+}
+
+// Returns the time of the last successful broker dial, if there has been one
+func (m *proxyMetrics) lastDialTime() (time.Time, bool) {
+	nanos := m.lastDial.Load()
+	if nanos == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+func newProxyMetrics() *proxyMetrics {
+	r := &registry{}
+	return &proxyMetrics{
+		registry: r,
+		activeConns: r.newMetric("kafka_proxy_active_connections",
+			"Number of client connections currently being proxied.", gauge, ""),
+		bytesPiped: r.newMetric("kafka_proxy_bytes_piped_total",
+			"Bytes piped between clients and the broker.", counter, "direction"),
+		dialFailures: r.newMetric("kafka_proxy_broker_dial_failures_total",
+			"Failed broker dials, by number of retries before the failure.", counter, "retries"),
+		throttleMs: r.newMetric("kafka_proxy_broker_throttle_ms_total",
+			"Time the broker reported throttling clients for (requires -decode).", counter, "api_key"),
+		dialPhaseSeconds: r.newMetric("kafka_proxy_broker_dial_phase_seconds_total",
+			"Time spent in each phase of broker dials (requires -trace-dial).", counter, "phase"),
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	r := &registry{}
+	g := r.newMetric("test_gauge", "A gauge.", gauge, "")
+	c := r.newMetric("test_total", "A counter.", counter, "kind")
+
+	g.add("", 2)
+	g.add("", -1)
+	c.add("b", 3)
+	c.add("a", 1)
+	c.add("b", 1)
+	assert.Equal(t, float64(1), g.value(""))
+	assert.Equal(t, float64(4), c.value("b"))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	expected := "# HELP test_gauge A gauge.\n" +
+		"# TYPE test_gauge gauge\n" +
+		"test_gauge 1\n" +
+		"# HELP test_total A counter.\n" +
+		"# TYPE test_total counter\n" +
+		"test_total{kind=\"a\"} 1\n" +
+		"test_total{kind=\"b\"} 4\n"
+	assert.Equal(t, expected, rec.Body.String())
+}
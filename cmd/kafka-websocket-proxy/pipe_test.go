@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Records the size of the buffers passed to Read
+type RecordingConn struct {
+	net.Conn
+	sizes []int
+}
+
+func (c *RecordingConn) Read(b []byte) (int, error) {
+	c.sizes = append(c.sizes, len(b))
+	return c.Conn.Read(b)
+}
+
+// Discards all writes
+type DiscardConn struct {
+	net.Conn
+}
+
+func (DiscardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func TestValidateBufSize(t *testing.T) {
+	assert.Nil(t, validateBufSize(1))
+	assert.Nil(t, validateBufSize(maxPipeBufSize))
+	assert.Error(t, validateBufSize(0))
+	assert.Error(t, validateBufSize(-1))
+	assert.Error(t, validateBufSize(maxPipeBufSize+1))
+}
+
+func TestPipeBufSize(t *testing.T) {
+	client, server := net.Pipe()
+	src := &RecordingConn{Conn: server}
+	go func() {
+		client.Write(make([]byte, 100))
+		client.Close()
+	}()
+
+	err := pipeFunc(context.Background(), src, DiscardConn{}, 12345, pipeTimeouts{}, nil, nil)()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.NotEmpty(t, src.sizes)
+	for _, size := range src.sizes {
+		assert.Equal(t, 12345, size, "pipe reads into buffer of configured size")
+	}
+}
+
+func TestPipeCancel(t *testing.T) {
+	// With and without a read timeout, which is set before every read
+	for _, timeouts := range []pipeTimeouts{{}, {read: time.Minute}} {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		// The client stays silent, so only the cancellation ends the pipe
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- pipeFunc(ctx, server, DiscardConn{}, 1024, timeouts, nil, nil)()
+		}()
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+		select {
+		case err := <-done:
+			assert.Nil(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("pipe didn't return after cancellation")
+		}
+		server.Close()
+	}
+}
+
+func BenchmarkPipe(b *testing.B) {
+	const total = 64 << 20
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.SetBytes(total)
+			for i := 0; i < b.N; i++ {
+				client, server := TCPPair(b)
+				go func() {
+					chunk := make([]byte, 1<<20)
+					for written := 0; written < total; written += len(chunk) {
+						client.Write(chunk)
+					}
+					client.Close()
+				}()
+				pipeFunc(context.Background(), server, DiscardConn{}, size, pipeTimeouts{}, nil, nil)()
+				server.Close()
+			}
+		})
+	}
+}
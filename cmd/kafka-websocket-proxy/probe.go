@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/maxwellpeterson/kafka-websocket-shim/pkg/shim"
+	"github.com/pkg/errors"
+)
+
+// How long -probe waits for each broker if -dial-timeout isn't set
+const defaultProbeTimeout = 10 * time.Second
+
+// Dials each broker once with a dialer built from cfg, and writes a line to w
+// for each one with the outcome of the WebSocket handshake: the HTTP status,
+// the negotiated subprotocol, and how long the handshake took. Returns whether
+// every broker was reached, so that -probe can fail a deploy pipeline
+func probe(w io.Writer, brokers []string, cfg shim.DialerConfig, timeout time.Duration) bool {
+	d := shim.NewDialer(cfg)
+	ok := true
+	// Each broker is only probed once, even if it's shared by several listen
+	// addresses
+	seen := make(map[string]bool, len(brokers))
+	for _, broker := range brokers {
+		if seen[broker] {
+			continue
+		}
+		seen[broker] = true
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		start := time.Now()
+		c, err := d.DialContext(ctx, "tcp", broker)
+		elapsed := time.Since(start)
+		cancel()
+		if err != nil {
+			ok = false
+			status := "none"
+			var statusErr shim.HandshakeStatusError
+			if errors.As(err, &statusErr) {
+				status = fmt.Sprint(statusErr.StatusCode)
+			}
+			fmt.Fprintf(w, "FAIL %s status=%s time=%s error=%q\n", broker, status, elapsed.Round(time.Microsecond), err.Error())
+			continue
+		}
+		conn := c.(*shim.Conn)
+		subprotocol := conn.Raw().Subprotocol()
+		if subprotocol == "" {
+			subprotocol = "none"
+		}
+		fmt.Fprintf(w, "OK %s url=%s status=101 subprotocol=%s compressed=%t time=%s\n",
+			broker, conn.URL(), subprotocol, conn.Compressed(), elapsed.Round(time.Microsecond))
+		conn.Close()
+	}
+	return ok
+}
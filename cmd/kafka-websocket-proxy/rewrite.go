@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/maxwellpeterson/kafka-websocket-shim/pkg/shim"
+)
+
+const apiKeyMetadata = 3
+
+// Rewrites the broker addresses in the Metadata responses flowing through a
+// single proxied connection to the address of the proxy. Otherwise the client
+// would go on to connect to the addresses the brokers advertise, which it
+// usually can't reach (and which would bypass the proxy if it could)
+//
+// Every broker is rewritten to the same address, since the proxy forwards
+// every connection to the same WebSocket endpoint, and the client still tells
+// the brokers apart by node ID. Only Metadata responses are rewritten, so
+// clients that connect to the host and port in FindCoordinator responses
+// aren't covered
+//
+// Note: Responses are buffered in full (like with -decode), so that a
+// rewritten response can be sent with its new size
+type metadataRewriter struct {
+	host   string
+	port   int32
+	logger *slog.Logger
+
+	requests  splitter
+	responses splitter
+
+	mu sync.Mutex
+	// The version of each Metadata request waiting for a response, by
+	// correlation ID
+	inflight map[int32]int16
+}
+
+func newMetadataRewriter(host string, port int32, logger *slog.Logger) *metadataRewriter {
+	return &metadataRewriter{host: host, port: port, logger: logger, inflight: make(map[int32]int16)}
+}
+
+// Returns the address to advertise to a client that connected over conn: the
+// port it connected to, and the host given by -advertise-host, or else the IP
+// address it connected to. Returns false if conn isn't a TCP connection
+func advertisedAddr(conn net.Conn) (string, int32, bool) {
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return "", 0, false
+	}
+	host := *advertiseHost
+	if host == "" {
+		host = addr.IP.String()
+	}
+	return host, int32(addr.Port), true
+}
+
+// Wraps the connection to the broker, so that Metadata requests are recorded
+// before they're sent, rather than racing with their responses
+func (r *metadataRewriter) trackRequests(broker net.Conn) net.Conn {
+	return requestTracker{Conn: broker, r: r}
+}
+
+// Wraps the connection to the client, so that Metadata responses are rewritten
+// before they're sent
+func (r *metadataRewriter) rewriteResponses(client net.Conn) net.Conn {
+	return responseRewriter{Conn: client, r: r}
+}
+
+func (r *metadataRewriter) observeRequests(b []byte) {
+	r.requests.split(b, func(msg []byte) {
+		h, ok := parseRequestHeader(msg)
+		if !ok || h.apiKey != apiKeyMetadata {
+			return
+		}
+		r.mu.Lock()
+		r.inflight[h.correlationID] = h.apiVersion
+		r.mu.Unlock()
+	})
+}
+
+// Returns the responses (including their size headers) that are completed by
+// b, with any Metadata responses rewritten. Once a response declares a size
+// that can't be right, it and everything after it is returned untouched
+func (r *metadataRewriter) rewrite(b []byte) []byte {
+	var out []byte
+	lost := r.responses.lost
+	unsplit := r.responses.split(b, func(msg []byte) {
+		if len(msg) >= int32Size {
+			correlationID := int32(binary.BigEndian.Uint32(msg))
+			r.mu.Lock()
+			version, ok := r.inflight[correlationID]
+			delete(r.inflight, correlationID)
+			r.mu.Unlock()
+			if ok {
+				if rewritten, ok := rewriteMetadataResponse(version, msg, r.host, r.port); ok {
+					msg = rewritten
+				} else {
+					r.logger.Warn("can't rewrite malformed metadata response", "api_version", version)
+				}
+			}
+		}
+		out = binary.BigEndian.AppendUint32(out, uint32(len(msg)))
+		out = append(out, msg...)
+	})
+	if !lost && r.responses.lost {
+		r.logger.Warn("response size exceeds maximum, no longer rewriting metadata", "max", shim.DefaultMaxMessageSize)
+	}
+	return append(out, unsplit...)
+}
+
+type requestTracker struct {
+	net.Conn
+	r *metadataRewriter
+}
+
+func (t requestTracker) Write(b []byte) (int, error) {
+	t.r.observeRequests(b)
+	return t.Conn.Write(b)
+}
+
+type responseRewriter struct {
+	net.Conn
+	r *metadataRewriter
+}
+
+// Reports b as written once it's buffered, even though an incomplete response
+// at the end of b is only sent once a later Write completes it
+func (w responseRewriter) Write(b []byte) (int, error) {
+	if out := w.r.rewrite(b); len(out) > 0 {
+		if _, err := w.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Returns a copy of msg, a Metadata response (excluding the size header) of the
+// given version, with the host and port of every broker replaced. Returns false
+// if msg is malformed
+func rewriteMetadataResponse(version int16, msg []byte, host string, port int32) ([]byte, bool) {
+	if len(msg) < int32Size {
+		return nil, false
+	}
+	flexible := version >= flexibleVersions[apiKeyMetadata]
+	// Skips the correlation ID, which is the rest of the header in
+	// non-flexible versions
+	offset := int32Size
+	if flexible {
+		n, ok := skipTaggedFields(msg[offset:])
+		if !ok {
+			return nil, false
+		}
+		offset += n
+	}
+	if version >= throttleVersions[apiKeyMetadata] {
+		offset += int32Size
+	}
+	if len(msg) < offset {
+		return nil, false
+	}
+	count, n, ok := readArrayLen(msg[offset:], flexible)
+	if !ok {
+		return nil, false
+	}
+	offset += n
+	out := append([]byte(nil), msg[:offset]...)
+	for i := 0; i < count; i++ {
+		// node_id is kept
+		if len(msg[offset:]) < int32Size {
+			return nil, false
+		}
+		out = append(out, msg[offset:offset+int32Size]...)
+		offset += int32Size
+
+		n, ok := skipString(msg[offset:], flexible)
+		if !ok {
+			return nil, false
+		}
+		offset += n
+		out = appendString(out, host, flexible)
+
+		if len(msg[offset:]) < int32Size {
+			return nil, false
+		}
+		offset += int32Size
+		out = binary.BigEndian.AppendUint32(out, uint32(port))
+
+		// The rack (from version 1) and the tagged fields (in flexible
+		// versions) are kept
+		start := offset
+		if version >= 1 {
+			n, ok := skipString(msg[offset:], flexible)
+			if !ok {
+				return nil, false
+			}
+			offset += n
+		}
+		if flexible {
+			n, ok := skipTaggedFields(msg[offset:])
+			if !ok {
+				return nil, false
+			}
+			offset += n
+		}
+		out = append(out, msg[start:offset]...)
+	}
+	// The topics and everything after them are kept
+	return append(out, msg[offset:]...), true
+}
+
+// Returns the number of elements in the array at the start of b, which is
+// zero for a null array, and the length of the array's length field
+func readArrayLen(b []byte, flexible bool) (int, int, bool) {
+	if flexible {
+		// The length is stored plus one, so that zero means null
+		l, n := binary.Uvarint(b)
+		if n <= 0 || l > uint64(len(b)) {
+			return 0, 0, false
+		}
+		if l == 0 {
+			return 0, n, true
+		}
+		return int(l - 1), n, true
+	}
+	if len(b) < int32Size {
+		return 0, 0, false
+	}
+	l := int32(binary.BigEndian.Uint32(b))
+	if l < 0 {
+		return 0, int32Size, true
+	}
+	return int(l), int32Size, true
+}
+
+// Returns the length of the (possibly null) string at the start of b
+func skipString(b []byte, flexible bool) (int, bool) {
+	if flexible {
+		l, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, false
+		}
+		if l == 0 {
+			return n, true
+		}
+		if uint64(len(b[n:])) < l-1 {
+			return 0, false
+		}
+		return n + int(l-1), true
+	}
+	if len(b) < int16Size {
+		return 0, false
+	}
+	l := int16(binary.BigEndian.Uint16(b))
+	if l < 0 {
+		return int16Size, true
+	}
+	if len(b[int16Size:]) < int(l) {
+		return 0, false
+	}
+	return int16Size + int(l), true
+}
+
+func appendString(b []byte, s string, flexible bool) []byte {
+	if flexible {
+		b = binary.AppendUvarint(b, uint64(len(s))+1)
+	} else {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	}
+	return append(b, s...)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Encodes a string for a non-flexible message
+func KafkaString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+// Encodes a string for a flexible message
+func CompactString(s string) []byte {
+	return append(binary.AppendUvarint(nil, uint64(len(s))+1), s...)
+}
+
+func TestRewriteMetadata(t *testing.T) {
+	r := newMetadataRewriter("proxy.local", 9999, logger)
+
+	// Metadata v1 has racks but no throttle time. Other requests are passed
+	// through untouched
+	r.observeRequests(MakeKafkaMsg(int16(3), int16(1), int32(7), int16(-1), int32(-1)))
+	r.observeRequests(MakeKafkaMsg(int16(18), int16(0), int32(8)))
+	resp := MakeKafkaMsg(int32(7), int32(2),
+		int32(0), KafkaString("kafka-0.internal"), int32(9092), int16(-1),
+		int32(1), KafkaString("kafka-1.internal"), int32(9092), KafkaString("rack-a"),
+		[]byte("topics"))
+	other := MakeKafkaMsg(int32(8), int16(0), []byte("api versions"))
+
+	// Responses can be split across writes arbitrarily
+	stream := append(resp, other...)
+	assert.Empty(t, r.rewrite(stream[:10]))
+	assert.Equal(t, append(MakeKafkaMsg(int32(7), int32(2),
+		int32(0), KafkaString("proxy.local"), int32(9999), int16(-1),
+		int32(1), KafkaString("proxy.local"), int32(9999), KafkaString("rack-a"),
+		[]byte("topics")), other...), r.rewrite(stream[10:]))
+
+	// Each request is only matched with one response
+	assert.Equal(t, resp, r.rewrite(resp))
+}
+
+func TestRewriteMetadataFlexible(t *testing.T) {
+	r := newMetadataRewriter("proxy.local", 9999, logger)
+
+	// Metadata v9 is flexible, and has a throttle time
+	r.observeRequests(MakeKafkaMsg(int16(3), int16(9), int32(1), int16(-1), []byte{0, 1, 0, 0, 0}))
+	resp := MakeKafkaMsg(int32(1), []byte{0}, int32(0), []byte{2},
+		int32(4), CompactString("kafka-4.internal"), int32(9092), []byte{0}, []byte{1, 3, 1, 0xaa},
+		[]byte("topics"))
+	assert.Equal(t, MakeKafkaMsg(int32(1), []byte{0}, int32(0), []byte{2},
+		int32(4), CompactString("proxy.local"), int32(9999), []byte{0}, []byte{1, 3, 1, 0xaa},
+		[]byte("topics")), r.rewrite(resp))
+}
+
+func TestRewriteMetadataMalformed(t *testing.T) {
+	r := newMetadataRewriter("proxy.local", 9999, logger)
+
+	// Malformed responses are passed through, rather than dropped
+	r.observeRequests(MakeKafkaMsg(int16(3), int16(1), int32(1)))
+	resp := MakeKafkaMsg(int32(1), int32(1), int32(0), KafkaString("kafka-0.internal"))
+	assert.Equal(t, resp, r.rewrite(resp))
+}
+
+func TestRewriteMetadataOversized(t *testing.T) {
+	r := newMetadataRewriter("proxy.local", 9999, logger)
+
+	// A response with a bogus size is passed through untouched, along with
+	// everything after it
+	r.observeRequests(MakeKafkaMsg(int16(3), int16(1), int32(1)))
+	r.observeRequests(MakeKafkaMsg(int16(3), int16(1), int32(2)))
+	bogus := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 1}
+	assert.Equal(t, bogus, r.rewrite(bogus))
+	resp := MakeKafkaMsg(int32(2), int32(1), int32(0), KafkaString("kafka-0.internal"), int32(9092), int16(-1))
+	assert.Equal(t, resp, r.rewrite(resp))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+	"golang.org/x/sync/errgroup"
+)
+
+// A listener, and the broker that the clients it accepts are forwarded to
+type Route struct {
+	Listener net.Listener
+	Broker   string
+	Dialer   proxy.ContextDialer
+}
+
+// Accepts client connections and forwards each one to the broker for the
+// listener it arrived on, until it's shut down. This is the proxy without the
+// flag parsing and signal handling of main, so that it can be started and
+// stopped in tests
+type Server struct {
+	routes       []Route
+	maxConns     int
+	blockConns   bool
+	drainTimeout time.Duration
+
+	// Closed by Shutdown, which makes Run return
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type ServerConfig struct {
+	Routes []Route
+	// The maximum number of concurrent connections across all of the
+	// listeners. Unlimited if zero
+	MaxConns int
+	// What to do with new connections at the limit: "reject" closes them right
+	// away, and "block" stops accepting until a connection closes
+	MaxConnsPolicy string
+	// How long to wait for open connections to close on shutdown before
+	// closing them
+	DrainTimeout time.Duration
+}
+
+func NewServer(cfg ServerConfig) *Server {
+	return &Server{
+		routes:       cfg.Routes,
+		maxConns:     cfg.MaxConns,
+		blockConns:   cfg.MaxConnsPolicy == "block",
+		drainTimeout: cfg.DrainTimeout,
+		stop:         make(chan struct{}),
+	}
+}
+
+// Serves clients until ctx is done, Shutdown is called, or a listener fails.
+// The listeners are closed, and open connections are drained, before it
+// returns. Returns the listener error if there was one
+func (s *Server) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// Connections get their own context, so that they can keep running while
+	// they are drained after the listener is closed
+	connCtx, closeConns := context.WithCancel(context.Background())
+	defer closeConns()
+	var conns errgroup.Group
+
+	// Each connection holds a slot in the semaphore while it's open
+	var sem chan struct{}
+	if s.maxConns > 0 {
+		sem = make(chan struct{}, s.maxConns)
+	}
+
+	g, acceptCtx := errgroup.WithContext(ctx)
+	// Each listener gets its own accept loop, forwarding to its own broker
+	for _, r := range s.routes {
+		r := r
+		g.Go(func() error {
+			for {
+				conn, err := r.Listener.Accept()
+				if err != nil {
+					select {
+					case <-acceptCtx.Done():
+						return nil
+					default:
+						// Returning error cancels context and triggers shutdown
+						return errors.Wrap(err, "listener failed")
+					}
+				}
+
+				id := newConnID()
+				connLogger := logger.With("conn_id", id, "remote_addr", conn.RemoteAddr().String())
+				if sem != nil && s.blockConns {
+					// Stop accepting until a slot frees up, leaving new clients
+					// waiting in the listen backlog. The slot is only taken
+					// once a client arrives, so that an idle listener doesn't
+					// hold one that another listener could use
+					select {
+					case sem <- struct{}{}:
+					case <-acceptCtx.Done():
+						conn.Close()
+						return nil
+					}
+				}
+				if sem != nil && !s.blockConns {
+					select {
+					case sem <- struct{}{}:
+					default:
+						connLogger.Warn("rejected tcp connection", "max_conns", s.maxConns)
+						conn.Close()
+						continue
+					}
+				}
+				connLogger.Info("accepted tcp connection")
+
+				conns.Go(func() error {
+					if sem != nil {
+						defer func() { <-sem }()
+					}
+					if err := handleClient(withConnID(connCtx, id), conn, r.Dialer, r.Broker, connLogger); err != nil {
+						connLogger.Warn("connection failed", "error", err)
+					} else {
+						connLogger.Info("closed tcp connection")
+					}
+					// Individual connections can fail without triggering shutdown
+					return nil
+				})
+			}
+		})
+	}
+
+	<-acceptCtx.Done()
+	var closeErr error
+	for _, r := range s.routes {
+		if err := r.Listener.Close(); err != nil && closeErr == nil {
+			closeErr = errors.Wrap(err, "close listener failed")
+		}
+	}
+	err := g.Wait()
+
+	// Give open connections a chance to close on their own before closing them
+	drained := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(s.drainTimeout):
+		logger.Info("closing open connections", "drain_timeout", s.drainTimeout)
+		closeConns()
+		<-drained
+	}
+
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Stops accepting new clients, which makes Run drain the open connections and
+// return. Safe to call more than once, and before Run
+func (s *Server) Shutdown() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+type connIDKey struct{}
+
+// Returns a random ID for a client connection, which ties together the log
+// lines for the connection and its broker connection
+func newConnID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+// Returns a context that carries the ID of the client connection it belongs to
+func withConnID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, connIDKey{}, id)
+}
+
+// Returns the ID of the client connection that ctx belongs to, or the empty
+// string if there isn't one
+func connIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(connIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/maxwellpeterson/kafka-websocket-shim/pkg/shim"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerProduce(t *testing.T) {
+	// Produce v3 with a single record for partition 0 of the "events" topic.
+	// The stub broker only looks at the request header and the record value
+	record := []byte("hello kafka")
+	request := MakeKafkaMsg(int16(0), int16(3), int32(42), int16(6), []byte("client"),
+		int16(-1), int16(1), int32(1000), int32(1), int16(6), []byte("events"),
+		int32(1), int32(0), int32(len(record)), record)
+	produced := make(chan []byte, 1)
+	broker, stop := StartBrokerHandler(t, func(c *websocket.Conn) {
+		for {
+			_, p, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			produced <- p
+			// Acknowledge with the correlation ID and an empty response
+			correlationID := int32(binary.BigEndian.Uint32(p[8:]))
+			if err := c.WriteMessage(websocket.BinaryMessage, MakeKafkaMsg(correlationID, int32(0), int32(0))); err != nil {
+				return
+			}
+		}
+	})
+	defer stop()
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	srv := NewServer(ServerConfig{Routes: []Route{
+		{Listener: ln, Broker: broker, Dialer: shim.NewDialer(shim.DialerConfig{})},
+	}})
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(context.Background()) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write(request)
+	assert.Nil(t, err)
+
+	select {
+	case p := <-produced:
+		assert.Equal(t, request, p)
+		assert.True(t, bytes.HasSuffix(p, record), "broker receives the record")
+	case <-time.After(5 * time.Second):
+		t.Fatal("record wasn't produced")
+	}
+	resp := make([]byte, int32Size+12)
+	_, err = io.ReadFull(conn, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(42), binary.BigEndian.Uint32(resp[int32Size:]), "client receives the ack")
+
+	srv.Shutdown()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+	_, err = net.Dial("tcp", ln.Addr().String())
+	assert.NotNil(t, err, "listener is closed after shutdown")
+}
+
+func TestServerListenerFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	srv := NewServer(ServerConfig{Routes: []Route{
+		{Listener: ln, Broker: "localhost:0", Dialer: shim.NewDialer(shim.DialerConfig{})},
+	}})
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(context.Background()) }()
+
+	// Closing the listener out from under the server fails it
+	ln.Close()
+	select {
+	case err := <-done:
+		assert.ErrorContains(t, err, "listener failed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+}
+
+func TestServerConnID(t *testing.T) {
+	var logs bytes.Buffer
+	l, err := newLogger(&logs, "info", "json")
+	assert.Nil(t, err)
+	defer func(l *slog.Logger) { logger = l }(logger)
+	logger = l
+
+	requestIDs := make(chan string, 1)
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestIDs <- r.Header.Get("X-Request-Id")
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, p, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(mt, p); err != nil {
+				return
+			}
+		}
+	}))
+	defer s.Close()
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	srv := NewServer(ServerConfig{Routes: []Route{
+		{Listener: ln, Broker: strings.TrimPrefix(s.URL, "http://"), Dialer: shim.NewDialer(shim.DialerConfig{})},
+	}, DrainTimeout: 5 * time.Second})
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(context.Background()) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	assert.Nil(t, RoundTrip(conn))
+	assert.Nil(t, conn.Close())
+
+	// Draining waits for the connection to finish logging
+	srv.Shutdown()
+	assert.Nil(t, <-done)
+
+	accepted := FindLogs(t, &logs, "accepted tcp connection")
+	if !assert.Len(t, accepted, 1) {
+		return
+	}
+	id := accepted[0]["conn_id"]
+	assert.NotEmpty(t, id)
+	for _, msg := range []string{"opened websocket connection", "closed tcp connection"} {
+		records := FindLogs(t, &logs, msg)
+		if assert.Len(t, records, 1, msg) {
+			assert.Equal(t, id, records[0]["conn_id"], msg)
+		}
+	}
+	assert.Equal(t, id, <-requestIDs, "broker receives the id")
+}
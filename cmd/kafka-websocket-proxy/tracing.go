@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Starts spans for proxied connections: one for the lifetime of each
+// connection, with child spans for dialing the broker (which has a span for
+// the handshake of each attempt) and for piping data once it's connected.
+// This is the subset of the OpenTelemetry tracing API that the proxy uses, so
+// an OpenTelemetry tracer can be plugged in with a thin adapter (see
+// tracing_otel.go), which keeps default builds free of a tracing client
+type tracer interface {
+	// Starts a span that is a child of the span in ctx, if there is one, and
+	// returns a context that carries the new span
+	Start(ctx context.Context, name string) (context.Context, span)
+}
+
+type span interface {
+	// Records something that happened at a point in time during the span
+	AddEvent(name string, attrs ...slog.Attr)
+	SetAttributes(attrs ...slog.Attr)
+	// Ends the span, marking it as failed if err is not nil
+	End(err error)
+}
+
+// Tracing is disabled by default
+var connTracer tracer = noopTracer{}
+
+// Set by builds with a tracing client (see tracing_otel.go), and called once
+// the flags are parsed to replace connTracer if tracing is enabled. Returns a
+// function that flushes the spans on shutdown, or nil if tracing isn't enabled
+var setupTracing func(ctx context.Context) (func(context.Context) error, error)
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) AddEvent(string, ...slog.Attr) {}
+func (noopSpan) SetAttributes(...slog.Attr)    {}
+func (noopSpan) End(error)                     {}
@@ -0,0 +1,96 @@
+//go:build otel
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Only in builds with -tags otel, which keeps the OpenTelemetry client out of
+// the default build
+var otlpTraces = flag.Bool("otlp-traces", false, "export connection spans over otlp/http, to the endpoint set by the standard OTEL_EXPORTER_OTLP_* environment variables")
+
+func init() {
+	setupTracing = setupOTLP
+}
+
+// Replaces connTracer with an OpenTelemetry tracer that exports batches of
+// spans over OTLP/HTTP, if -otlp-traces is set. The exporter and the service
+// name are configured with the standard environment variables (such as
+// OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_SERVICE_NAME)
+func setupOTLP(ctx context.Context) (func(context.Context) error, error) {
+	if !*otlpTraces {
+		return nil, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "create otlp exporter failed")
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	connTracer = newOTelTracer(provider)
+	return provider.Shutdown, nil
+}
+
+// Adapts an OpenTelemetry tracer to the tracer that the proxy uses
+type otelTracer struct {
+	t trace.Tracer
+}
+
+func newOTelTracer(provider trace.TracerProvider) otelTracer {
+	return otelTracer{t: provider.Tracer("github.com/maxwellpeterson/kafka-websocket-shim/cmd/kafka-websocket-proxy")}
+}
+
+func (o otelTracer) Start(ctx context.Context, name string) (context.Context, span) {
+	ctx, s := o.t.Start(ctx, name)
+	return ctx, otelSpan{s}
+}
+
+type otelSpan struct {
+	s trace.Span
+}
+
+func (s otelSpan) AddEvent(name string, attrs ...slog.Attr) {
+	s.s.AddEvent(name, trace.WithAttributes(otelAttrs(attrs)...))
+}
+
+func (s otelSpan) SetAttributes(attrs ...slog.Attr) {
+	s.s.SetAttributes(otelAttrs(attrs)...)
+}
+
+func (s otelSpan) End(err error) {
+	if err != nil {
+		s.s.RecordError(err)
+		s.s.SetStatus(codes.Error, err.Error())
+	}
+	s.s.End()
+}
+
+// Converts slog attributes to OpenTelemetry attributes, keeping the types
+// that both support, and formatting the others as strings
+func otelAttrs(attrs []slog.Attr) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, len(attrs))
+	for i, a := range attrs {
+		switch v := a.Value.Resolve(); v.Kind() {
+		case slog.KindInt64:
+			kvs[i] = attribute.Int64(a.Key, v.Int64())
+		case slog.KindUint64:
+			kvs[i] = attribute.Int64(a.Key, int64(v.Uint64()))
+		case slog.KindFloat64:
+			kvs[i] = attribute.Float64(a.Key, v.Float64())
+		case slog.KindBool:
+			kvs[i] = attribute.Bool(a.Key, v.Bool())
+		default:
+			kvs[i] = attribute.String(a.Key, v.String())
+		}
+	}
+	return kvs
+}
@@ -0,0 +1,91 @@
+//go:build otel
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Returns a tracer that records the spans it ends in memory
+func StartOTel(t *testing.T) *tracetest.SpanRecorder {
+	prev := connTracer
+	t.Cleanup(func() { connTracer = prev })
+	rec := tracetest.NewSpanRecorder()
+	connTracer = newOTelTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	return rec
+}
+
+// Returns the ended spans with the given name
+func FindOTel(rec *tracetest.SpanRecorder, name string) []sdktrace.ReadOnlySpan {
+	var found []sdktrace.ReadOnlySpan
+	for _, s := range rec.Ended() {
+		if s.Name() == name {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+func TestOTelSpans(t *testing.T) {
+	rec := StartOTel(t)
+
+	msg := []byte{0, 0, 0, 4, 'k', 'a', 'f', 'k'}
+	addr := ProxyMessage(t, msg)
+
+	conns := FindOTel(rec, "proxy.connection")
+	dials := FindOTel(rec, "proxy.dial_broker")
+	handshakes := FindOTel(rec, "proxy.handshake")
+	pipes := FindOTel(rec, "proxy.pipe")
+	if !assert.Len(t, conns, 1) || !assert.Len(t, dials, 1) || !assert.Len(t, handshakes, 1) || !assert.Len(t, pipes, 1) {
+		return
+	}
+	conn, dial, handshake, pipe := conns[0], dials[0], handshakes[0], pipes[0]
+	assert.Subset(t, conn.Attributes(), []attribute.KeyValue{
+		attribute.String("broker", addr),
+		attribute.String("conn_id", "c0ffee"),
+		attribute.Int64("bytes_up", int64(len(msg))),
+		attribute.Int64("bytes_down", int64(len(msg))),
+	})
+	assert.Equal(t, codes.Unset, conn.Status().Code)
+	assert.False(t, conn.Parent().IsValid(), "the connection is a root span")
+	assert.Equal(t, conn.SpanContext().SpanID(), dial.Parent().SpanID())
+	assert.Equal(t, dial.SpanContext().SpanID(), handshake.Parent().SpanID())
+	assert.Equal(t, conn.SpanContext().SpanID(), pipe.Parent().SpanID())
+	assert.Equal(t, conn.SpanContext().TraceID(), pipe.SpanContext().TraceID())
+	assert.Contains(t, handshake.Attributes(), attribute.Int64("retries", 0))
+	assert.Equal(t, codes.Unset, pipe.Status().Code)
+}
+
+func TestOTelDialRetrySpans(t *testing.T) {
+	rec := StartOTel(t)
+	defer func(d time.Duration) { *dialBackoff = d }(*dialBackoff)
+	*dialBackoff = time.Millisecond
+
+	_, err := dialBroker(context.Background(), FailingDialer{}, "localhost:8787", logger)
+	assert.NotNil(t, err)
+
+	dials := FindOTel(rec, "proxy.dial_broker")
+	if assert.Len(t, dials, 1) {
+		assert.Equal(t, codes.Error, dials[0].Status().Code)
+		var failed int
+		for _, e := range dials[0].Events() {
+			if e.Name == "dial failed" {
+				failed++
+			}
+		}
+		assert.Equal(t, dialBrokerRetries, failed)
+	}
+	handshakes := FindOTel(rec, "proxy.handshake")
+	assert.Len(t, handshakes, dialBrokerRetries)
+	for _, h := range handshakes {
+		assert.Equal(t, codes.Error, h.Status().Code)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxwellpeterson/kafka-websocket-shim/pkg/shim"
+	"github.com/stretchr/testify/assert"
+)
+
+// Keeps every span in memory, so that tests can check what was traced
+type RecordingTracer struct {
+	mu    sync.Mutex
+	spans []*RecordedSpan
+}
+
+type RecordedSpan struct {
+	Name   string
+	Parent *RecordedSpan
+	Attrs  map[string]any
+	Events []string
+	Err    error
+	Ended  bool
+}
+
+type recordedSpanKey struct{}
+
+func (r *RecordingTracer) Start(ctx context.Context, name string) (context.Context, span) {
+	s := &RecordedSpan{Name: name, Attrs: map[string]any{}}
+	s.Parent, _ = ctx.Value(recordedSpanKey{}).(*RecordedSpan)
+	r.mu.Lock()
+	r.spans = append(r.spans, s)
+	r.mu.Unlock()
+	return context.WithValue(ctx, recordedSpanKey{}, s), recordingSpan{r, s}
+}
+
+// Returns the spans with the given name
+func (r *RecordingTracer) Find(name string) []*RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var found []*RecordedSpan
+	for _, s := range r.spans {
+		if s.Name == name {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+type recordingSpan struct {
+	r *RecordingTracer
+	s *RecordedSpan
+}
+
+func (s recordingSpan) AddEvent(name string, attrs ...slog.Attr) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	s.s.Events = append(s.s.Events, name)
+}
+
+func (s recordingSpan) SetAttributes(attrs ...slog.Attr) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	for _, a := range attrs {
+		s.s.Attrs[a.Key] = a.Value.Any()
+	}
+}
+
+func (s recordingSpan) End(err error) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	s.s.Err = err
+	s.s.Ended = true
+}
+
+// Proxies msg to an echo broker and back with handleClient, using the conn ID
+// c0ffee, and returns the address of the broker once the client has closed
+// the connection
+func ProxyMessage(t *testing.T, msg []byte) string {
+	addr, stop := StartBroker(t)
+	defer stop()
+
+	client, server := TCPPair(t)
+	done := make(chan error)
+	go func() {
+		dialer := shim.NewDialer(shim.DialerConfig{})
+		done <- handleClient(withConnID(context.Background(), "c0ffee"), server, dialer, addr, logger)
+	}()
+	_, err := client.Write(msg)
+	assert.Nil(t, err)
+	_, err = io.ReadFull(client, make([]byte, len(msg)))
+	assert.Nil(t, err)
+	assert.Nil(t, client.Close())
+	assert.Nil(t, <-done)
+	return addr
+}
+
+func TestConnectionSpans(t *testing.T) {
+	defer func(t tracer) { connTracer = t }(connTracer)
+	rec := &RecordingTracer{}
+	connTracer = rec
+
+	msg := []byte{0, 0, 0, 4, 'k', 'a', 'f', 'k'}
+	addr := ProxyMessage(t, msg)
+
+	conns := rec.Find("proxy.connection")
+	dials := rec.Find("proxy.dial_broker")
+	handshakes := rec.Find("proxy.handshake")
+	pipes := rec.Find("proxy.pipe")
+	if !assert.Len(t, conns, 1) || !assert.Len(t, dials, 1) || !assert.Len(t, handshakes, 1) || !assert.Len(t, pipes, 1) {
+		return
+	}
+	conn, dial, handshake, pipe := conns[0], dials[0], handshakes[0], pipes[0]
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	assert.True(t, conn.Ended)
+	assert.Nil(t, conn.Err)
+	assert.Equal(t, addr, conn.Attrs["broker"])
+	assert.Equal(t, "c0ffee", conn.Attrs["conn_id"])
+	assert.Equal(t, int64(len(msg)), conn.Attrs["bytes_up"])
+	assert.Equal(t, int64(len(msg)), conn.Attrs["bytes_down"])
+	assert.Same(t, conn, dial.Parent, "the dial is a child of the connection")
+	assert.True(t, dial.Ended)
+	assert.Empty(t, dial.Events)
+	assert.Same(t, dial, handshake.Parent, "the handshake is a child of the dial")
+	assert.True(t, handshake.Ended)
+	assert.Nil(t, handshake.Err)
+	assert.Equal(t, int64(0), handshake.Attrs["retries"])
+	assert.Same(t, conn, pipe.Parent, "the pipe is a child of the connection")
+	assert.True(t, pipe.Ended)
+	assert.Nil(t, pipe.Err)
+}
+
+func TestDialRetrySpanEvents(t *testing.T) {
+	defer func(t tracer) { connTracer = t }(connTracer)
+	rec := &RecordingTracer{}
+	connTracer = rec
+	defer func(d time.Duration) { *dialBackoff = d }(*dialBackoff)
+	*dialBackoff = time.Millisecond
+
+	_, err := dialBroker(context.Background(), FailingDialer{}, "localhost:8787", logger)
+	assert.NotNil(t, err)
+
+	dials := rec.Find("proxy.dial_broker")
+	handshakes := rec.Find("proxy.handshake")
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if assert.Len(t, dials, 1) {
+		assert.Len(t, dials[0].Events, dialBrokerRetries)
+		assert.Equal(t, err, dials[0].Err)
+	}
+	// Each attempt has a failed handshake span
+	if assert.Len(t, handshakes, dialBrokerRetries) {
+		for i, h := range handshakes {
+			assert.Equal(t, int64(i), h.Attrs["retries"])
+			assert.NotNil(t, h.Err)
+		}
+	}
+}
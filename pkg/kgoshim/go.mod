@@ -0,0 +1,25 @@
+module github.com/maxwellpeterson/kafka-websocket-shim/pkg/kgoshim
+
+go 1.21
+
+require (
+	github.com/gorilla/websocket v1.5.0
+	github.com/maxwellpeterson/kafka-websocket-shim v0.0.0
+	github.com/stretchr/testify v1.8.4
+	github.com/twmb/franz-go v1.15.4
+	github.com/twmb/franz-go/pkg/kmsg v1.7.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/klauspost/compress v1.16.7 // indirect
+	github.com/kr/pretty v0.1.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.19 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/maxwellpeterson/kafka-websocket-shim => ../..
@@ -0,0 +1,21 @@
+// Wires the shim into franz-go clients. This is a separate module, so that
+// the shim package doesn't depend on franz-go
+package kgoshim
+
+import (
+	"github.com/maxwellpeterson/kafka-websocket-shim/pkg/shim"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Returns the options for a franz-go client that connects to the broker
+// through the shim, using a dialer created from cfg. Record batches are sent
+// uncompressed, since the broker stores batches as they are sent. Callers pass
+// the broker address with kgo.SeedBrokers, and can add kgo.MaxVersions to
+// match the API versions that the broker supports
+func Opts(cfg shim.DialerConfig) []kgo.Opt {
+	dialer := shim.NewDialer(cfg)
+	return []kgo.Opt{
+		kgo.Dialer(dialer.DialContext),
+		kgo.ProducerBatchCompression(kgo.NoCompression()),
+	}
+}
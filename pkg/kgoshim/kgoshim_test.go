@@ -0,0 +1,142 @@
+package kgoshim
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/maxwellpeterson/kafka-websocket-shim/pkg/shim"
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// The API key of ApiVersions requests, which franz-go sends first on every
+// connection
+const apiVersionsKey = 18
+
+const metadataKey = 3
+
+func TestOpts(t *testing.T) {
+	keys := make(chan int16, 10)
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// Records the API key of each request, after the size header, without
+		// responding
+		for {
+			_, p, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if len(p) >= 6 {
+				keys <- int16(binary.BigEndian.Uint16(p[4:6]))
+			}
+		}
+	}))
+	defer s.Close()
+
+	opts := Opts(shim.DialerConfig{})
+	opts = append(opts, kgo.SeedBrokers(strings.TrimPrefix(s.URL, "http://")))
+	client, err := kgo.NewClient(opts...)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go client.Ping(ctx)
+	select {
+	case key := <-keys:
+		assert.Equal(t, int16(apiVersionsKey), key, "client sends requests through the shim")
+	case <-time.After(5 * time.Second):
+		t.Fatal("broker received no requests")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	keys := make(chan int16, 100)
+	l := shim.NewPipeListener()
+	s := &http.Server{Handler: shim.NewUpgrader(shim.UpgraderConfig{}).Handler(func(c net.Conn) {
+		FakeBroker(c, keys)
+	})}
+	go s.Serve(l)
+	defer s.Close()
+
+	// Every broker address is dialed through the pipe, including the one the
+	// fake broker advertises
+	opts := Opts(shim.DialerConfig{NetDialContext: l.DialContext})
+	opts = append(opts, kgo.SeedBrokers("seed.example:9092"))
+	client, err := kgo.NewClient(opts...)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := kmsg.NewPtrMetadataRequest().RequestWith(ctx, client)
+	assert.Nil(t, err)
+	assert.Equal(t, []kmsg.MetadataResponseBroker{{NodeID: 1, Host: "broker.example", Port: 9092}}, resp.Brokers)
+	assert.Equal(t, int16(apiVersionsKey), <-keys, "client negotiates versions first")
+	assert.Equal(t, int16(metadataKey), <-keys)
+}
+
+// Answers the ApiVersions and Metadata requests read from c, which are enough
+// for a franz-go client to issue a Metadata request, and sends the API key of
+// each request to keys. Returns once c fails, or on any other request
+func FakeBroker(c net.Conn, keys chan<- int16) {
+	defer c.Close()
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(c, header[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(header[:]))
+		if _, err := io.ReadFull(c, req); err != nil || len(req) < 8 {
+			return
+		}
+		key := int16(binary.BigEndian.Uint16(req))
+		version := int16(binary.BigEndian.Uint16(req[2:]))
+		select {
+		case keys <- key:
+		default:
+		}
+		var resp kmsg.Response
+		switch key {
+		case apiVersionsKey:
+			r := kmsg.NewPtrApiVersionsResponse()
+			r.ApiKeys = []kmsg.ApiVersionsResponseApiKey{
+				{ApiKey: apiVersionsKey, MaxVersion: 3},
+				{ApiKey: metadataKey, MaxVersion: 12},
+			}
+			resp = r
+		case metadataKey:
+			r := kmsg.NewPtrMetadataResponse()
+			r.Brokers = []kmsg.MetadataResponseBroker{{NodeID: 1, Host: "broker.example", Port: 9092}}
+			resp = r
+		default:
+			return
+		}
+		resp.SetVersion(version)
+		// The response header is the correlation ID, followed by tagged
+		// fields in flexible versions (except in ApiVersions responses)
+		out := append(make([]byte, 4), req[4:8]...)
+		if resp.IsFlexible() && key != apiVersionsKey {
+			out = append(out, 0)
+		}
+		out = resp.AppendTo(out)
+		binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+		if _, err := c.Write(out); err != nil {
+			return
+		}
+	}
+}
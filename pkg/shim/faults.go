@@ -0,0 +1,73 @@
+package shim
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Returned by the Read or Write that a FaultConfig disconnected
+var ErrInjectedDisconnect = errors.New("shim: injected disconnect")
+
+// Injects faults into the WebSocket messages a connection sends and receives,
+// for testing how a Kafka client copes with a flaky network. Each message is
+// delayed by Latency, and then disconnects or is dropped with the configured
+// probabilities. A disconnect closes the WebSocket connection without a close
+// message, like a dropped TCP connection, so with Reconnect the next Read or
+// Write redials. A dropped message is skipped: Write reports it as sent
+// without sending it, and Read discards it and waits for the next one
+//
+// Each connection draws from its own random source seeded with Seed, so a
+// connection that sends and receives the same messages sees the same faults
+// from one run to the next
+type FaultConfig struct {
+	// Added before each message is sent or handed to Read
+	Latency time.Duration
+	// The chance, from 0 to 1, that a message disconnects the connection
+	DisconnectProbability float64
+	// The chance, from 0 to 1, that a message is dropped
+	DropProbability float64
+	Seed            int64
+}
+
+type fault int
+
+const (
+	faultNone fault = iota
+	faultDrop
+	faultDisconnect
+)
+
+// Decides the fault for each message, from a random source that is shared by
+// Read and Write
+type faultInjector struct {
+	cfg FaultConfig
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newFaultInjector(cfg FaultConfig) *faultInjector {
+	return &faultInjector{cfg: cfg, rng: rand.New(rand.NewSource(cfg.Seed))}
+}
+
+// Waits out the latency, and returns the fault for the next message. A single
+// number is drawn per message, so the disconnect and drop probabilities don't
+// shift each other's sequence
+func (f *faultInjector) next() fault {
+	f.mu.Lock()
+	x := f.rng.Float64()
+	f.mu.Unlock()
+	if f.cfg.Latency > 0 {
+		time.Sleep(f.cfg.Latency)
+	}
+	switch {
+	case x < f.cfg.DisconnectProbability:
+		return faultDisconnect
+	case x < f.cfg.DisconnectProbability+f.cfg.DropProbability:
+		return faultDrop
+	}
+	return faultNone
+}
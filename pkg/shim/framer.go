@@ -0,0 +1,42 @@
+package shim
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Splits the byte stream that a Kafka client writes into messages, using the
+// length prefix in front of each one, and makes the prefix for the messages
+// read from the broker when StripSizeHeader leaves it off the wire. This lets
+// the shim carry protocols that frame messages differently from Kafka, such
+// as with a varint prefix. Each message is sent in its own WebSocket message
+// (unless BufferWrites coalesces them), with its prefix unless it's stripped
+type Framer interface {
+	// Reads the prefix at the start of p, returning its length and the length
+	// of the message after it. Returns io.ErrUnexpectedEOF if p ends before the
+	// prefix does, and any other error if the prefix is malformed, which fails
+	// the Write (and every later Write, since the stream can't be resynced).
+	// A length of zero or less fails the Write with InvalidFrameSizeError
+	ReadFrame(p []byte) (prefixLen int, msgLen int, err error)
+	// Appends the prefix for a message of msgLen bytes to dst. The prefix for
+	// a longer message must be at least as long, since Read makes room for
+	// the prefix of the longest message before reading one
+	WriteFrame(dst []byte, msgLen int) []byte
+}
+
+// Frames messages with the 4 byte big-endian size header of the Kafka
+// protocol. This is the default
+type Int32Framer struct{}
+
+func (Int32Framer) ReadFrame(p []byte) (int, int, error) {
+	if len(p) < int32Size {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	// The size is signed, so that a size with the high bit set is rejected as
+	// negative rather than taken as a message of over 2GB
+	return int32Size, int(int32(binary.BigEndian.Uint32(p))), nil
+}
+
+func (Int32Framer) WriteFrame(dst []byte, msgLen int) []byte {
+	return binary.BigEndian.AppendUint32(dst, uint32(msgLen))
+}
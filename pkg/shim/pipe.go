@@ -0,0 +1,74 @@
+package shim
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// An in-memory net.Listener, which accepts the server side of the net.Pipe
+// connections opened by DialContext. Serving a WebSocket server (such as an
+// http.Server that upgrades with Upgrader) on it, and dialing it by setting
+// DialContext as DialerConfig.NetDialContext, connects the two without
+// binding a port, which keeps tests from failing when a port is taken
+//
+// Note: Unlike TCP connections, pipes have no buffering, so every write
+// blocks until the other side reads it
+type PipeListener struct {
+	conns chan net.Conn
+
+	// Closed when the listener is closed
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// Opens a connection to the listener. The network and address are ignored,
+// so that this can be used as DialerConfig.NetDialContext for any broker
+// address. Waits until the connection is accepted, or fails if the listener
+// is closed or ctx is done first
+func (l *PipeListener) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, errors.Wrap(net.ErrClosed, "shim: dial pipe failed")
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, errors.Wrap(ctx.Err(), "shim: dial pipe failed")
+	}
+}
+
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Stops accepting connections. Connections that were already accepted stay
+// open
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,153 @@
+package shim
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Returned by Get once the pooled dialer has been closed
+var ErrPoolClosed = errors.New("shim: pooled dialer closed")
+
+// Keeps the connections that are handed back with Put open, and hands them
+// out again from Get, so that tools that open many short connections to the
+// same broker skip the WebSocket handshake. There is a pool of idle
+// connections for each broker address, which are closed once they have been
+// idle for IdleTimeout
+//
+// Note: An idle connection that the broker closed isn't noticed until it's
+// used, so callers should be ready for the first request on a connection from
+// Get to fail, and not Put connections that failed
+type PooledDialer struct {
+	dialer      *Dialer
+	idleTimeout time.Duration
+	maxIdle     int
+
+	mu     sync.Mutex
+	idle   map[string][]*idleConn
+	closed bool
+}
+
+type PooledDialerConfig struct {
+	// Dials the connections for the pool. A dialer with the default config is
+	// used if nil
+	Dialer *Dialer
+	// How long a connection can sit in the pool before it's closed. Idle
+	// connections are kept until they are used if zero
+	IdleTimeout time.Duration
+	// The most idle connections kept for each broker, beyond which Put closes
+	// the connection instead. Unlimited if zero
+	MaxIdlePerBroker int
+}
+
+// A connection waiting in the pool, with the timer that evicts it
+type idleConn struct {
+	conn  *Conn
+	timer *time.Timer
+}
+
+func NewPooledDialer(cfg PooledDialerConfig) *PooledDialer {
+	p := &PooledDialer{
+		dialer:      cfg.Dialer,
+		idleTimeout: cfg.IdleTimeout,
+		maxIdle:     cfg.MaxIdlePerBroker,
+		idle:        map[string][]*idleConn{},
+	}
+	if p.dialer == nil {
+		p.dialer = NewDialer(DialerConfig{})
+	}
+	return p
+}
+
+// Returns the most recently pooled connection to the broker at addr, or dials
+// a new one if there are none. Pooled connections have their deadlines and
+// read limit cleared, so they start out like a new connection
+func (p *PooledDialer) Get(ctx context.Context, addr string) (net.Conn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	var ic *idleConn
+	if conns := p.idle[addr]; len(conns) > 0 {
+		ic = conns[len(conns)-1]
+		p.idle[addr] = conns[:len(conns)-1]
+	}
+	p.mu.Unlock()
+	if ic == nil {
+		return p.dialer.DialContext(ctx, "tcp", addr)
+	}
+	if ic.timer != nil {
+		ic.timer.Stop()
+	}
+	if err := ic.conn.SetDeadline(time.Time{}); err != nil {
+		ic.conn.Close()
+		return nil, err
+	}
+	ic.conn.SetReadLimit(0)
+	return ic.conn, nil
+}
+
+// Hands a connection from Get back to the pool for its broker, once the
+// caller is done with it. Connections that can't be reused are closed
+// instead: ones that aren't from a Dialer, have been closed, or are in the
+// middle of a message (with part of a response left unread, or part of a
+// request written), since the next user would see the stream out of step
+func (p *PooledDialer) Put(c net.Conn) {
+	conn, ok := c.(*Conn)
+	if !ok || !conn.reusable() {
+		c.Close()
+		return
+	}
+	// Get dials the broker address as the host of the URL
+	addr := conn.url.Host
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || (p.maxIdle > 0 && len(p.idle[addr]) >= p.maxIdle) {
+		conn.Close()
+		return
+	}
+	ic := &idleConn{conn: conn}
+	if p.idleTimeout > 0 {
+		ic.timer = time.AfterFunc(p.idleTimeout, func() { p.evict(addr, ic) })
+	}
+	p.idle[addr] = append(p.idle[addr], ic)
+}
+
+// Closes a connection that has been idle for too long, unless Get has taken
+// it already
+func (p *PooledDialer) evict(addr string, ic *idleConn) {
+	p.mu.Lock()
+	conns := p.idle[addr]
+	for i, other := range conns {
+		if other == ic {
+			p.idle[addr] = append(conns[:i], conns[i+1:]...)
+			p.mu.Unlock()
+			ic.conn.Close()
+			return
+		}
+	}
+	p.mu.Unlock()
+}
+
+// Closes the idle connections, and makes later calls to Get fail. Connections
+// that are checked out stay open, and are closed when they are Put back
+func (p *PooledDialer) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = map[string][]*idleConn{}
+	p.mu.Unlock()
+	for _, conns := range idle {
+		for _, ic := range conns {
+			if ic.timer != nil {
+				ic.timer.Stop()
+			}
+			ic.conn.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package shim
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Returned by Write in async write mode when the write queue is full and
+// DialerConfig.WriteQueueNonBlocking is set
+var ErrWriteQueueFull = errors.New("shim: write queue full")
+
+// Holds the WebSocket messages that Write has framed in async write mode,
+// until the writer goroutine sends them. The writer is the only sender while
+// the queue is open, so messages go out in the order they were queued
+type writeQueue struct {
+	frames   chan queuedFrame
+	nonBlock bool
+	// Closed once the writer has sent (or given up on) every queued message
+	done chan struct{}
+
+	// The first send that failed, which fails every later Write, since the
+	// messages after it can't be delivered in order
+	mu  sync.Mutex
+	err error
+}
+
+// A WebSocket message waiting in the queue, with the number of Kafka protocol
+// messages it holds
+type queuedFrame struct {
+	p         []byte
+	kafkaMsgs int
+}
+
+// Starts the writer goroutine for a queue of up to size messages
+func (c *Conn) startWriteQueue(size int, nonBlock bool) {
+	q := &writeQueue{
+		frames:   make(chan queuedFrame, size),
+		nonBlock: nonBlock,
+		done:     make(chan struct{}),
+	}
+	c.queue = q
+	go func() {
+		defer close(q.done)
+		for f := range q.frames {
+			// The rest of the queue is drained after a failure, so that
+			// Write doesn't wait on a queue that nothing empties
+			if q.failed() != nil {
+				continue
+			}
+			if err := c.writeMessage(f.p, f.kafkaMsgs); err != nil {
+				q.fail(err)
+			}
+		}
+	}()
+}
+
+// Copies p into the queue, waiting for room if the queue is full. Must be
+// called with writeMu held
+func (q *writeQueue) enqueue(p []byte, kafkaMsgs int) error {
+	if err := q.failed(); err != nil {
+		return err
+	}
+	q.frames <- queuedFrame{p: append([]byte(nil), p...), kafkaMsgs: kafkaMsgs}
+	return nil
+}
+
+// Returns whether a Write should fail with ErrWriteQueueFull instead of
+// waiting. This is checked once at the start of a Write, so a Write fails
+// without queueing anything, rather than partway through
+func (q *writeQueue) full() bool {
+	return q.nonBlock && len(q.frames) == cap(q.frames)
+}
+
+func (q *writeQueue) fail(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.err = err
+}
+
+func (q *writeQueue) failed() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
+// Waits for the writer to send the queued messages, and stops it. Must be
+// called with writeMu held, so that no Write queues a message after this
+func (q *writeQueue) close() error {
+	close(q.frames)
+	<-q.done
+	return q.failed()
+}
@@ -0,0 +1,50 @@
+package shim
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A token bucket that limits the bytes sent per second, which holds up to a
+// second's worth of bytes for bursts. This is the small part of
+// golang.org/x/time/rate that Write needs, without taking on the dependency
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// Waits until n bytes can be sent. The bytes are taken from the bucket up
+// front, which can leave it in debt, so a message larger than the burst only
+// waits for the bytes it's missing. Fails with a timeout error, without taking
+// anything from the bucket, if the wait would run past deadline
+func (l *rateLimiter) wait(n int, deadline time.Time) error {
+	l.mu.Lock()
+	now := time.Now()
+	tokens := min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate) - float64(n)
+	var delay time.Duration
+	if tokens < 0 {
+		delay = time.Duration(-tokens / l.rate * float64(time.Second))
+	}
+	if !deadline.IsZero() && now.Add(delay).After(deadline) {
+		l.mu.Unlock()
+		return errors.Wrap(os.ErrDeadlineExceeded, "shim: wait for write rate limit failed")
+	}
+	l.tokens = tokens
+	l.last = now
+	l.mu.Unlock()
+	time.Sleep(delay)
+	return nil
+}
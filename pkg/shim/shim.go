@@ -1,11 +1,23 @@
 package shim
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,12 +26,29 @@ import (
 
 const (
 	int32Size = 4
+	// Bounds the time Close spends sending a close message to a broker that
+	// isn't reading
+	closeTimeout = time.Second
+
+	// The largest message buffer that Read keeps around for the next message
+	maxReusedReadBuffer = 1 << 20
+
+	DefaultMaxMessageSize = 100 << 20
+	DefaultUserAgent      = "kafka-websocket-shim"
 )
 
+// The version of the shim, which is set at build time with
+// -ldflags "-X github.com/maxwellpeterson/kafka-websocket-shim/pkg/shim.Version=..."
+var Version = "dev"
+
+// Returned (wrapped) by Read, Write and Flush once the connection has been
+// closed with Close, which tells an intentional close apart from an I/O error
+var ErrConnClosed = errors.New("shim: connection closed")
+
 type InvalidNetworkError string
 
 func (e InvalidNetworkError) Error() string {
-	return fmt.Sprintf("shim: invalid network: expected tcp but got %s", string(e))
+	return fmt.Sprintf("shim: invalid network: expected tcp, tcp4, or tcp6 but got %s", string(e))
 }
 
 type InvalidMessageTypeError int
@@ -29,38 +58,796 @@ func (e InvalidMessageTypeError) Error() string {
 		websocket.BinaryMessage, e)
 }
 
+// Returned by Read in StrictBinary mode when the broker sends a text message,
+// with the start of the text, which is usually an error from a misconfigured
+// gateway. Matches InvalidMessageTypeError with errors.Is
+type TextMessageError struct {
+	// The first 256 bytes of the message, or all of it if it is shorter
+	Payload   string
+	Truncated bool
+}
+
+func (e TextMessageError) Error() string {
+	ellipsis := ""
+	if e.Truncated {
+		ellipsis = "..."
+	}
+	return fmt.Sprintf("shim: invalid websocket message type: expected binary but got text: %q%s", e.Payload, ellipsis)
+}
+
+func (e TextMessageError) Is(target error) bool {
+	return target == InvalidMessageTypeError(websocket.TextMessage)
+}
+
+// The most text that TextMessageError shows
+const maxTextPayload = 256
+
+type InsecureURLError string
+
+func (e InsecureURLError) Error() string {
+	return fmt.Sprintf("shim: refusing to dial %s: tls is required", string(e))
+}
+
+type DialSLOError time.Duration
+
+func (e DialSLOError) Error() string {
+	return fmt.Sprintf("shim: dial exceeded slo of %s", time.Duration(e))
+}
+
+type OversizedFrameError struct {
+	Size uint32
+	Max  int
+}
+
+func (e OversizedFrameError) Error() string {
+	return fmt.Sprintf("shim: kafka message size %d exceeds maximum of %d", e.Size, e.Max)
+}
+
+// Returned by Write when a Kafka protocol message declares a size of zero or
+// less (sizes are signed, so a size with the high bit set is negative). Every
+// Kafka request has a header, so either means the client has lost track of
+// where its messages start, and the rest of the stream can't be trusted
+type InvalidFrameSizeError struct {
+	Size int
+}
+
+func (e InvalidFrameSizeError) Error() string {
+	return fmt.Sprintf("shim: invalid kafka message size %d", e.Size)
+}
+
+// Returned by Write when the partial Kafka protocol message it's holding on
+// to grows past DialerConfig.MaxWriteBuffer, such as when a client declares a
+// large size and then trickles bytes that never complete the message
+type WriteBufferFullError struct {
+	Size int
+	Max  int
+}
+
+func (e WriteBufferFullError) Error() string {
+	return fmt.Sprintf("shim: %d buffered bytes of incomplete kafka message exceed maximum of %d", e.Size, e.Max)
+}
+
+// Returned when the broker (or a gateway in front of it) answers the upgrade
+// request with an HTTP status other than 101 Switching Protocols, such as 401
+// when authentication fails or 404 when the route is wrong. Matches
+// websocket.ErrBadHandshake with errors.Is
+type HandshakeStatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e HandshakeStatusError) Error() string {
+	return fmt.Sprintf("shim: websocket upgrade to %s failed with http status %d %s",
+		e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e HandshakeStatusError) Unwrap() error {
+	return websocket.ErrBadHandshake
+}
+
+// Returned when the broker (or a gateway in front of it) only accepts HTTP/2.
+// WebSockets over HTTP/2 (RFC 8441) aren't supported by the underlying
+// WebSocket library, so HTTP/1.1 needs to be enabled on the gateway instead
+type HTTP2OnlyError string
+
+func (e HTTP2OnlyError) Error() string {
+	return fmt.Sprintf("shim: %s only accepts http/2, but websockets need http/1.1: enable http/1.1 on the server", string(e))
+}
+
+// Returned by Read when the broker closes the WebSocket connection with a close
+// code other than normal closure (which is returned as io.EOF), so that
+// callers can react to application close codes (like an expired credential)
+type ShimCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e ShimCloseError) Error() string {
+	return fmt.Sprintf("shim: websocket closed with code %d: %s", e.Code, e.Reason)
+}
+
 // Implements proxy.Dialer and proxy.ContextDialer
 type Dialer struct {
-	tls bool
+	tls          bool
+	requireTLS   bool
+	dialSLO      time.Duration
+	streamReads  bool
+	reconnect    bool
+	traceDial    func(DialTiming, error)
+	retryCount   int
+	retryBackoff time.Duration
+	retryMult    float64
+	retryJitter  float64
+	logger       *slog.Logger
+	maxMsgSize   int
+	maxWriteBuf  int
+	writeBufSize int
+	wsReadBuf    int
+	wsWriteBuf   int
+	wsWritePool  websocket.BufferPool
+	compression  bool
+	writeTimeout time.Duration
+	writeRate    int
+	writeQueue   int
+	queueNoBlock bool
+	faults       *FaultConfig
+	idleTimeout  time.Duration
+	origin       string
+	userAgent    string
+	reqHeader    func(ctx context.Context) (http.Header, error)
+	bufferWrites bool
+	stripHeader  bool
+	strictBinary bool
+	framer       Framer
+	dialTimeout  time.Duration
+	frameDump    io.Writer
+	lookupHost   func(ctx context.Context, host string) ([]string, error)
+	netDialCtx   func(ctx context.Context, network, addr string) (net.Conn, error)
+	tcpKeepAlive time.Duration
+	onRead       func(n int)
+	onWrite      func(n int)
 }
 
 type DialerConfig struct {
 	TLS bool
+	// Refuse to dial plaintext ws:// URLs, which prevents Kafka traffic from
+	// accidentally being sent unencrypted when TLS is not enabled. Dials fail
+	// with InsecureURLError instead
+	RequireTLS bool
+	// Bounds the total time taken to establish a connection, including DNS
+	// resolution, TCP connect, TLS handshake, and WebSocket upgrade. Dials that
+	// take longer fail with DialSLOError. No bound is applied if zero
+	DialSLO time.Duration
+	// Read WebSocket messages incrementally into the caller's buffer, instead
+	// of reading each message in full and buffering whatever doesn't fit. This
+	// bounds memory use by the size of the caller's buffer rather than the size
+	// of the message, which matters for large fetch responses
+	StreamReads bool
+	// Transparently redial the broker when a read or write fails, and resume
+	// on the new connection. A write that fails is sent again over the new
+	// connection, along with the rest of the Kafka protocol messages buffered
+	// by Write
+	//
+	// Note: This gives at-least-once delivery for requests. A request that
+	// reached the broker before the connection failed is sent again, and a
+	// response that was in flight is lost, so callers must use idempotent
+	// requests (or tolerate duplicates) and time out requests whose responses
+	// never arrive. Normal closure by the broker and timeouts are still
+	// returned as errors
+	Reconnect bool
+	// Called after every dial (including redials in reconnect mode) with the
+	// time spent in each phase of the dial, and the error if the dial failed.
+	// This helps pinpoint which phase is slow when connecting takes too long
+	TraceDial func(t DialTiming, err error)
+	// The number of times to retry a failed dial, waiting RetryBackoff before
+	// the first retry and multiplying the wait by RetryMultiplier (or doubling
+	// it, if zero) before each retry after that. This gives a broker that is
+	// still starting up time to become ready. The dial SLO applies to each
+	// attempt separately
+	RetryCount      int
+	RetryBackoff    time.Duration
+	RetryMultiplier float64
+	// The fraction of each retry wait to randomize, from 0 (none) to 1 (full
+	// jitter). Each wait is reduced by a random fraction of up to RetryJitter,
+	// so that connections that fail together, like when the broker restarts,
+	// don't redial in lockstep
+	RetryJitter float64
+	// Receives debug logs for dials and connection lifecycle events, which
+	// helps diagnose why a connection died. Nothing is logged if nil
+	Logger *slog.Logger
+	// The largest Kafka protocol message that Write accepts, as declared by
+	// the size header. Writes that declare a larger size fail with
+	// OversizedFrameError, rather than buffering data while waiting for the
+	// rest of a message that will never arrive. DefaultMaxMessageSize is used
+	// if zero
+	MaxMessageSize int
+	// The most bytes of an incomplete Kafka protocol message that Write holds
+	// on to while waiting for the rest of it. Writes that grow the partial
+	// message past this fail with WriteBufferFullError, which bounds the
+	// memory a misbehaving client can use below MaxMessageSize. Complete
+	// messages waiting for Flush in buffered write mode don't count towards
+	// it. There is no limit besides MaxMessageSize if zero
+	MaxWriteBuffer int
+	// The initial capacity of the buffer that Write assembles Kafka protocol
+	// messages in. The buffer grows when a message doesn't fit, and keeps its
+	// size for later writes, so this only saves the reallocations while it
+	// grows. Set it to the size of a typical produce request for clients that
+	// send bursts of large requests on new connections. The buffer starts
+	// empty if zero
+	WriteBufferSize int
+	// The sizes of the buffers the WebSocket connection reads from and writes
+	// to the network through. Larger buffers take fewer syscalls to move
+	// large messages, such as fetch responses, at the cost of memory for each
+	// connection. Not to be confused with WriteBufferSize. The WebSocket
+	// library's default (4 KiB) is used if zero
+	WebSocketReadBufferSize  int
+	WebSocketWriteBufferSize int
+	// A pool that WebSocket connections take a write buffer from to send each
+	// message, and return it to afterwards, instead of each holding on to a
+	// buffer for its lifetime. This saves memory with many connections that
+	// are mostly idle. Dialers that share a pool should use the same
+	// WebSocketWriteBufferSize. Each connection has its own buffer if nil,
+	// unless ShareWebSocketWriteBuffers is set
+	WebSocketWriteBufferPool websocket.BufferPool
+	// Use a write buffer pool that is shared with every other Dialer in the
+	// process with the same WebSocketWriteBufferSize, if
+	// WebSocketWriteBufferPool isn't set
+	ShareWebSocketWriteBuffers bool
+	// Negotiate the permessage-deflate extension with the broker, and compress
+	// the messages sent over the connection. This saves bandwidth over slow
+	// links at the cost of CPU on both ends, but most of the savings come from
+	// metadata and uncompressed record batches. Record batches that producers
+	// already compress (with gzip, snappy, lz4, or zstd) won't shrink much
+	// further
+	// A broker that doesn't support the extension is still connected to,
+	// without compression, which Conn.Compressed reports
+	EnableCompression bool
+	// Bounds the time taken to send each WebSocket message, so that a broker
+	// that stops reading can't block Write forever. Writes that take longer
+	// fail with a timeout error. A deadline set with SetWriteDeadline still
+	// applies if it comes first. No bound is applied if zero
+	WriteTimeout time.Duration
+	// Limits how fast the connection sends to the broker, in bytes per
+	// second, so that a noisy client can't flood a shared broker. Each
+	// WebSocket message waits until the limit allows it, with bursts of up to
+	// a second's worth of bytes. The wait counts towards the write deadline
+	// (and WriteTimeout), and a message that can't be sent before the
+	// deadline fails with a timeout error without waiting. Unlimited if zero
+	WriteRateLimit int
+	// Makes Write queue each WebSocket message for a writer goroutine to
+	// send, and return without waiting for the broker, so that a broker that
+	// reads slowly doesn't hold up the producer. This is the most messages
+	// the queue holds, beyond which Write waits for room (or fails, with
+	// WriteQueueNonBlocking). Errors from sending a queued message are
+	// returned by the next Write, and Close sends the queued messages before
+	// closing. Write sends each message itself if zero
+	WriteQueueSize int
+	// Makes Write fail with ErrWriteQueueFull, without queueing anything,
+	// instead of waiting when the write queue is full
+	WriteQueueNonBlocking bool
+	// Injects latency, disconnects, and dropped messages into the connection,
+	// for testing Kafka clients against a flaky network. No faults are
+	// injected if nil
+	Faults *FaultConfig
+	// Fail reads once nothing has been received from the broker for this long,
+	// which detects half-open connections that TCP keepalive misses. The
+	// broker is pinged at half this interval, so an idle broker that is still
+	// reading (and sending pongs) keeps the connection alive. A deadline set
+	// with SetReadDeadline still applies if it comes first. Disabled if zero
+	IdleTimeout time.Duration
+	// The Origin header to send with the WebSocket upgrade request, for
+	// gateways that reject upgrades without a matching origin. No Origin
+	// header is sent if empty
+	Origin string
+	// The User-Agent header to send with the WebSocket upgrade request, so
+	// that gateways can tell shim clients apart in their logs.
+	// DefaultUserAgent followed by the Version (as in "name/version") is used
+	// if empty
+	UserAgent string
+	// Returns headers to send with the WebSocket upgrade request, on top of
+	// the others, such as an Authorization header with a short-lived token.
+	// It's called before every dial attempt, including retries and the
+	// redials of reconnect mode, so a replacement connection authenticates
+	// with a fresh token instead of the one the connection started with. An
+	// error fails the attempt. Not called if nil
+	RequestHeader func(ctx context.Context) (http.Header, error)
+	// Hold the Kafka protocol messages passed to Write until Flush is called,
+	// and then send all of the complete messages in a single WebSocket
+	// message. This gives callers control over batching, which cuts the
+	// number of WebSocket frames when many small requests are sent at once
+	//
+	// Note: The broker must accept multiple Kafka protocol messages in the
+	// same WebSocket message, and split them using the size headers
+	BufferWrites bool
+	// Leave the 4 byte size header of each Kafka protocol message (or the
+	// prefix that Framer reads) off the wire, since WebSocket framing already
+	// gives the size. Read restores the header from the length of the
+	// WebSocket message, so the connection looks the same to the client. This
+	// saves bandwidth when messages are small
+	//
+	// Note: The broker must be configured to expect messages without size
+	// headers as well, otherwise it won't be able to read anything. Each
+	// WebSocket message from the broker must hold exactly one Kafka protocol
+	// message. This can't be combined with StreamReads or BufferWrites, which
+	// both need the size headers, and dials fail if they are
+	StripSizeHeader bool
+	// Splits the byte stream that the client writes into messages, and makes
+	// the prefix that Read restores with StripSizeHeader. Int32Framer, which
+	// reads the Kafka size header, is used if nil
+	Framer Framer
+	// Fail a Read that gets a text message with TextMessageError, which shows
+	// the start of the text, instead of InvalidMessageTypeError. A gateway
+	// that accepts the upgrade but isn't connected to a broker often sends an
+	// error page as text, which this makes visible where the client reports
+	// the failure. No probe is made when dialing, since a broker doesn't
+	// send anything until the client does, so the text is only seen on Read
+	StrictBinary bool
+	// Bounds the total time DialContext spends dialing, including every retry
+	// and the waits between them, which is simpler than tuning RetryCount and
+	// RetryBackoff to fit a time budget. No bound is applied if zero
+	DialTimeout time.Duration
+	// Receives a hex dump of every WebSocket message sent ("send") or
+	// received ("recv"), for troubleshooting protocol negotiation. In
+	// streaming mode, received messages are dumped in the chunks that Read
+	// returns. Nothing is dumped if nil
+	FrameDump io.Writer
+	// Resolves the broker host to the addresses to connect to, such as
+	// (*net.Resolver).LookupHost with a custom resolver. The host is resolved
+	// on every dial, without caching, so new connections follow DNS changes.
+	// The system resolver is used if nil
+	LookupHost func(ctx context.Context, host string) ([]string, error)
+	// Opens the TCP connection to the broker, which allows things like pinning
+	// the source address or setting socket options. It's called with each
+	// address from LookupHost if that's set, otherwise with the broker address.
+	// A net.Dialer is used if nil
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// The interval between TCP keepalive probes on the connection to the
+	// broker, which detects a dead broker (or a broken path to it) at the OS
+	// level, even while the WebSocket connection is idle. It's applied to the
+	// connection returned by NetDialContext too, if the connection supports
+	// keepalives. Keepalives are disabled if negative. The net.Dialer default
+	// (or whatever NetDialContext sets) is left alone if zero
+	TCPKeepAlive time.Duration
+	// Called with the size of each WebSocket message received from and sent
+	// to the broker, for feeding byte counts to a metrics system without
+	// polling Stats. In streaming mode, OnRead is called with each chunk that
+	// Read returns. They're called from the goroutine doing the Read or Write,
+	// so they should be quick
+	OnRead  func(n int)
+	OnWrite func(n int)
 }
 
 func NewDialer(cfg DialerConfig) *Dialer {
-	return &Dialer{tls: cfg.TLS}
+	d := &Dialer{
+		tls:          cfg.TLS,
+		requireTLS:   cfg.RequireTLS,
+		dialSLO:      cfg.DialSLO,
+		streamReads:  cfg.StreamReads,
+		reconnect:    cfg.Reconnect,
+		traceDial:    cfg.TraceDial,
+		retryCount:   cfg.RetryCount,
+		retryBackoff: cfg.RetryBackoff,
+		retryMult:    cfg.RetryMultiplier,
+		retryJitter:  cfg.RetryJitter,
+		logger:       cfg.Logger,
+		maxMsgSize:   cfg.MaxMessageSize,
+		maxWriteBuf:  cfg.MaxWriteBuffer,
+		writeBufSize: cfg.WriteBufferSize,
+		wsReadBuf:    cfg.WebSocketReadBufferSize,
+		wsWriteBuf:   cfg.WebSocketWriteBufferSize,
+		wsWritePool:  cfg.WebSocketWriteBufferPool,
+		compression:  cfg.EnableCompression,
+		writeTimeout: cfg.WriteTimeout,
+		writeRate:    cfg.WriteRateLimit,
+		writeQueue:   cfg.WriteQueueSize,
+		queueNoBlock: cfg.WriteQueueNonBlocking,
+		faults:       cfg.Faults,
+		idleTimeout:  cfg.IdleTimeout,
+		origin:       cfg.Origin,
+		userAgent:    cfg.UserAgent,
+		reqHeader:    cfg.RequestHeader,
+		bufferWrites: cfg.BufferWrites,
+		stripHeader:  cfg.StripSizeHeader,
+		strictBinary: cfg.StrictBinary,
+		framer:       cfg.Framer,
+		dialTimeout:  cfg.DialTimeout,
+		frameDump:    cfg.FrameDump,
+		lookupHost:   cfg.LookupHost,
+		netDialCtx:   cfg.NetDialContext,
+		tcpKeepAlive: cfg.TCPKeepAlive,
+		onRead:       cfg.OnRead,
+		onWrite:      cfg.OnWrite,
+	}
+	if d.maxMsgSize == 0 {
+		d.maxMsgSize = DefaultMaxMessageSize
+	}
+	if d.retryMult == 0 {
+		d.retryMult = 2
+	}
+	if d.framer == nil {
+		d.framer = Int32Framer{}
+	}
+	if d.userAgent == "" {
+		d.userAgent = DefaultUserAgent + "/" + Version
+	}
+	if d.logger == nil {
+		// Debug logs are disabled by the default level, so they are dropped
+		// before being formatted
+		d.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if d.wsWritePool == nil && cfg.ShareWebSocketWriteBuffers {
+		d.wsWritePool = sharedWriteBufferPool(d.wsWriteBuf)
+	}
+	return d
+}
+
+// The write buffer pools shared by dialers with ShareWebSocketWriteBuffers,
+// one for each write buffer size, since a pool should only hold buffers of
+// the size its connections expect
+var sharedWriteBufferPools struct {
+	sync.Mutex
+	pools map[int]*sync.Pool
+}
+
+func sharedWriteBufferPool(size int) *sync.Pool {
+	sharedWriteBufferPools.Lock()
+	defer sharedWriteBufferPools.Unlock()
+	if sharedWriteBufferPools.pools == nil {
+		sharedWriteBufferPools.pools = map[int]*sync.Pool{}
+	}
+	p, ok := sharedWriteBufferPools.pools[size]
+	if !ok {
+		p = &sync.Pool{}
+		sharedWriteBufferPools.pools[size] = p
+	}
+	return p
 }
 
 func (d Dialer) Dial(network, addr string) (net.Conn, error) {
 	return d.DialContext(context.Background(), network, addr)
 }
 
+// Accepts the tcp, tcp4, and tcp6 networks, which are all dialed the same
+// way, since the WebSocket connection doesn't pick the IP family from the
+// network. The address is a host and port, with IPv6 hosts in brackets (such
+// as [::1]:8787), just like for net.Dial
 func (d Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	if network != "tcp" {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
 		return nil, InvalidNetworkError(network)
 	}
+	// An IPv6 host without brackets would make a URL with a mangled host, so
+	// the address is checked before it goes into one
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, errors.Wrap(err, "shim: invalid broker address")
+	}
 	u := url.URL{Host: addr}
 	if d.tls {
 		u.Scheme = "wss"
 	} else {
 		u.Scheme = "ws"
 	}
-	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if d.requireTLS && u.Scheme != "wss" {
+		return nil, InsecureURLError(u.String())
+	}
+	if d.stripHeader && (d.streamReads || d.bufferWrites) {
+		return nil, errors.New("shim: StripSizeHeader can't be combined with StreamReads or BufferWrites")
+	}
+	header := d.requestHeader(ctx)
+	dialCtx := ctx
+	if d.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, d.dialTimeout)
+		defer cancel()
+	}
+	ws, compressed, err := d.dial(dialCtx, u.String(), header)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		ws:           ws,
+		url:          u,
+		streamReads:  d.streamReads,
+		maxMsgSize:   d.maxMsgSize,
+		maxWriteBuf:  d.maxWriteBuf,
+		wBuf:         make([]byte, 0, d.writeBufSize),
+		writeTimeout: d.writeTimeout,
+		idleTimeout:  d.idleTimeout,
+		bufferWrites: d.bufferWrites,
+		stripHeader:  d.stripHeader,
+		strictBinary: d.strictBinary,
+		framer:       d.framer,
+		frameDump:    d.frameDump,
+		onRead:       d.onRead,
+		onWrite:      d.onWrite,
+		logger:       d.logger,
+	}
+	c.compressed.Store(compressed)
+	if d.writeRate > 0 {
+		c.writeLimiter = newRateLimiter(d.writeRate)
+	}
+	if d.faults != nil {
+		c.faults = newFaultInjector(*d.faults)
+	}
+	if d.writeQueue > 0 {
+		c.startWriteQueue(d.writeQueue, d.queueNoBlock)
+	}
+	if c.idleTimeout > 0 {
+		c.watchIdle(ws)
+	}
+	if d.reconnect {
+		c.redial = func(ctx context.Context) (*websocket.Conn, bool, error) {
+			return d.dial(ctx, u.String(), header)
+		}
+	}
+	c.touch()
+	return c, nil
+}
+
+type requestHeaderKey struct{}
+
+// Returns a context that makes DialContext send header with the WebSocket
+// upgrade request, such as X-Forwarded-For when proxying a client connection.
+// This passes per-connection headers through code that only sees a
+// proxy.ContextDialer
+func WithRequestHeader(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, requestHeaderKey{}, header)
+}
+
+// Releases the resources shared by the connections that the dialer opens,
+// which doesn't affect connections that are already open. The dialer doesn't
+// hold any shared resources yet, so this does nothing, but callers that are
+// done with a dialer should still call it. Safe to call more than once
+func (d Dialer) Close() error {
+	return nil
+}
+
+// Returns the headers to send with the upgrade request, which are kept for
+// redials
+func (d Dialer) requestHeader(ctx context.Context) http.Header {
+	header := http.Header{}
+	if h, ok := ctx.Value(requestHeaderKey{}).(http.Header); ok {
+		header = h.Clone()
+	}
+	if d.origin != "" {
+		header.Set("Origin", d.origin)
+	}
+	if d.userAgent != "" {
+		header.Set("User-Agent", d.userAgent)
+	}
+	return header
+}
+
+// Adds the headers from the RequestHeader callback to the headers that every
+// attempt sends
+func (d Dialer) attemptHeader(ctx context.Context, header http.Header) (http.Header, error) {
+	if d.reqHeader == nil {
+		return header, nil
+	}
+	h, err := d.reqHeader(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "shim: get request header failed")
+	}
+	header = header.Clone()
+	for k, v := range h {
+		header[http.CanonicalHeaderKey(k)] = v
+	}
+	return header, nil
+}
+
+// Opens a WebSocket connection with the broker at url, retrying failed dials
+// with exponential backoff
+func (d Dialer) dial(ctx context.Context, url string, header http.Header) (*websocket.Conn, bool, error) {
+	wait := d.retryBackoff
+	for i := 0; ; i++ {
+		ws, compressed, err := d.dialOnce(ctx, url, header)
+		if err == nil || i >= d.retryCount {
+			return ws, compressed, err
+		}
+		t := time.NewTimer(time.Duration(float64(wait) * (1 - d.retryJitter*rand.Float64())))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, false, errors.Wrap(ctx.Err(), "shim: dial websocket failed")
+		}
+		wait = time.Duration(float64(wait) * d.retryMult)
+	}
+}
+
+// Makes a single attempt at opening a WebSocket connection with the broker at
+// url, applying the dial SLO. Also returns whether the broker agreed to
+// compress the connection
+func (d Dialer) dialOnce(ctx context.Context, url string, header http.Header) (*websocket.Conn, bool, error) {
+	d.logger.Debug("dialing websocket", "url", url)
+	header, err := d.attemptHeader(ctx, header)
+	if err != nil {
+		d.logger.Debug("dial websocket failed", "url", url, "error", err)
+		return nil, false, err
+	}
+	var ws *websocket.Conn
+	var compressed bool
+	if d.traceDial == nil {
+		ws, compressed, err = d.dialUntraced(ctx, url, header)
+	} else {
+		t := newDialTracer()
+		ws, compressed, err = d.dialUntraced(httptrace.WithClientTrace(ctx, t.clientTrace()), url, header)
+		d.traceDial(t.finish(), err)
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "shim: dial websocket failed")
+		d.logger.Debug("dial websocket failed", "url", url, "error", err)
+		return nil, false, err
 	}
-	return &Conn{ws: ws}, nil
+	d.logger.Debug("dialed websocket", "url", url, "remote_addr", ws.RemoteAddr().String(), "compressed", compressed)
+	return ws, compressed, nil
+}
+
+func (d Dialer) dialUntraced(ctx context.Context, url string, header http.Header) (*websocket.Conn, bool, error) {
+	dialCtx := ctx
+	if d.dialSLO > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, d.dialSLO)
+		defer cancel()
+	}
+	dialer := d.wsDialer()
+	var peek *peekConn
+	dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := d.netDial(ctx, network, addr)
+		if err != nil || d.tls {
+			return conn, err
+		}
+		// Without TLS, an HTTP/2 server can only be recognized by its
+		// response, which the WebSocket dialer doesn't return if it isn't HTTP
+		peek = &peekConn{Conn: conn}
+		return peek, nil
+	}
+	ws, resp, err := dialer.DialContext(dialCtx, url, header)
+	if err != nil {
+		// Only blame the SLO if the caller's context is still live, otherwise
+		// the caller gave up on its own. The SLO deadline is checked directly,
+		// since the dial can fail on the connection deadline (which is set from
+		// the same deadline) before the context itself reports that it expired
+		if d.dialSLO > 0 && ctx.Err() == nil {
+			if deadline, _ := dialCtx.Deadline(); !time.Now().Before(deadline) {
+				return nil, false, DialSLOError(d.dialSLO)
+			}
+		}
+		// The TLS alert isn't exported as a type, so it's matched by message
+		if strings.Contains(err.Error(), "tls: no application protocol") || (peek != nil && peek.isHTTP2()) {
+			return nil, false, HTTP2OnlyError(url)
+		}
+		if errors.Is(err, websocket.ErrBadHandshake) && resp != nil {
+			return nil, false, HandshakeStatusError{URL: url, StatusCode: resp.StatusCode}
+		}
+		return nil, false, errors.Wrap(err, "shim: dial websocket failed")
+	}
+	// A broker that doesn't support compression leaves the extension out of
+	// its response, and the connection carries on uncompressed
+	compressed := d.compression && hasCompression(resp.Header)
+	ws.EnableWriteCompression(compressed)
+	return ws, compressed, nil
+}
+
+// Reports whether the Sec-WebSocket-Extensions header of a handshake lists
+// the permessage-deflate extension
+func hasCompression(h http.Header) bool {
+	for _, v := range h.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the WebSocket dialer with the settings that don't depend on the dial
+func (d Dialer) wsDialer() websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = d.compression
+	dialer.ReadBufferSize = d.wsReadBuf
+	dialer.WriteBufferSize = d.wsWriteBuf
+	dialer.WriteBufferPool = d.wsWritePool
+	// Offering http/1.1 explicitly makes a server that only speaks HTTP/2
+	// fail the TLS handshake, rather than an upgrade that can never work
+	dialer.TLSClientConfig = &tls.Config{NextProtos: []string{"http/1.1"}}
+	return dialer
+}
+
+// Opens a TCP connection with addr using NetDialContext, resolving the host
+// with LookupHost if it's set. Each address is tried in turn until one connects
+func (d Dialer) netDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := d.netDialCtx
+	if dial == nil {
+		var nd net.Dialer
+		dial = nd.DialContext
+	}
+	if d.tcpKeepAlive != 0 {
+		dial = withKeepAlive(dial, d.tcpKeepAlive)
+	}
+	if d.lookupHost == nil {
+		return dial(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := d.lookupHost(ctx, host)
+	if err != nil {
+		return nil, errors.Wrap(err, "shim: lookup host failed")
+	}
+	dialErr := errors.Errorf("shim: no addresses found for %s", host)
+	for _, a := range addrs {
+		conn, err := dial(ctx, network, net.JoinHostPort(a, port))
+		if err == nil {
+			return conn, nil
+		}
+		dialErr = err
+	}
+	return nil, dialErr
+}
+
+// Implemented by *net.TCPConn, and by wrappers that pass keepalive settings
+// through to one
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// Wraps dial to configure TCP keepalives on the connections it opens before
+// they are used, disabling them if period is negative. Connections that don't
+// support keepalives are returned as is
+func withKeepAlive(dial func(ctx context.Context, network, addr string) (net.Conn, error), period time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		kc, ok := conn.(keepAliveConn)
+		if !ok {
+			return conn, nil
+		}
+		if err := kc.SetKeepAlive(period > 0); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "shim: set tcp keepalive failed")
+		}
+		if period > 0 {
+			if err := kc.SetKeepAlivePeriod(period); err != nil {
+				conn.Close()
+				return nil, errors.Wrap(err, "shim: set tcp keepalive failed")
+			}
+		}
+		return conn, nil
+	}
+}
+
+// The size of an HTTP/2 frame header, which starts every HTTP/2 response
+const http2FrameHeaderSize = 9
+
+// Keeps the start of the response to the upgrade request, so that a failed
+// upgrade can be diagnosed. The start is filled in by the reads during the
+// upgrade, and later reads leave it alone, so it isn't guarded
+type peekConn struct {
+	net.Conn
+	head []byte
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if len(c.head) < http2FrameHeaderSize {
+		c.head = append(c.head, b[:min(n, http2FrameHeaderSize-len(c.head))]...)
+	}
+	return n, err
+}
+
+// Reports whether the response started with the SETTINGS frame that HTTP/2
+// servers send first on every connection
+func (c *peekConn) isHTTP2() bool {
+	const settingsFrame = 0x4
+	return len(c.head) == http2FrameHeaderSize && c.head[3] == settingsFrame &&
+		binary.BigEndian.Uint32(c.head[5:]) == 0
 }
 
 // Implements net.Conn
@@ -68,46 +855,781 @@ func (d Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn
 // Note: Only Kafka protocol messages can be read or written. This means no TLS
 // handshake! This isn't a serious problem since the underlying WebSocket
 // connection can provide TLS on its own
+//
+// Like a TCP connection, Read and Write can be called concurrently with each
+// other, and the deadline methods (and SetReadLimit) can be called from any
+// goroutine, including while a Read is blocked (which is how a client unblocks
+// a read when it shuts down). Concurrent calls to Read are serialized, since
+// they would otherwise interleave the bytes of different messages, and so are
+// concurrent calls to Write (and Flush)
+//
+// Pings from the broker are answered with pongs by Read, since the WebSocket
+// connection only handles control messages while it's reading. A client that
+// doesn't keep a Read pending while the connection is idle (Kafka clients
+// normally keep one pending on each broker connection) leaves the pings
+// unanswered until its next Read, and a broker that expects timely pongs may
+// close the connection. A separate reader for control messages isn't possible,
+// since the WebSocket connection reads them in line with the data messages
 type Conn struct {
-	ws   *websocket.Conn
-	rBuf []byte
-	wBuf []byte
+	// Guards ws, which can be replaced by swap while reads and writes are in
+	// progress, along with the deadlines that need to carry over to the new
+	// connection. The read and write buffers are only touched by Read and
+	// Write (or Flush) respectively, so they don't need to be guarded
+	mu            sync.Mutex
+	ws            *websocket.Conn
+	url           url.URL
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readLimit     int64
+	rBuf          []byte
+	wBuf          []byte
+	msgBuf        bytes.Buffer
+	// Counts the calls that set the read deadline, so that ReadContext can
+	// tell whether the deadline it's restoring was replaced meanwhile
+	readDeadlineGen uint64
+
+	// Held for the duration of Read, so that only one goroutine uses the read
+	// buffer and the read methods of the underlying WebSocket at a time
+	readMu sync.Mutex
+	// Held for the duration of Write and Flush, which does the same for the
+	// write buffer and the write methods. Control messages (pings and the
+	// close message) don't need it, since the WebSocket connection serializes
+	// them with data messages on its own
+	writeMu sync.Mutex
+
+	// In streaming mode, the reader for the WebSocket message currently being
+	// read, or nil if the next Read should start a new message. Like the read
+	// buffer, this is only touched by Read
+	streamReads bool
+	r           io.Reader
+
+	// Whether the last successful Read continued a WebSocket message that an
+	// earlier Read started
+	lastReadBuffered atomic.Bool
+
+	maxMsgSize   int
+	maxWriteBuf  int
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+
+	// Applies the write rate limit to each WebSocket message sent, if there is
+	// one
+	writeLimiter *rateLimiter
+	// Injects faults into each WebSocket message sent and received, if
+	// configured
+	faults *faultInjector
+
+	// In async write mode, the messages waiting for the writer goroutine
+	queue *writeQueue
+
+	// In buffered write mode, the length (and number) of the complete Kafka
+	// protocol messages at the start of the write buffer, which are sent by
+	// Flush
+	bufferWrites  bool
+	wComplete     int
+	wCompleteMsgs int
+	// The error from a malformed or oversized size header, which every later
+	// Write returns, since the stream can't be resynchronized after it
+	wErr error
+
+	// Whether size headers are left off the wire, and restored by Read
+	stripHeader bool
+	// Whether text messages fail Read with their content
+	strictBinary bool
+	// Finds the messages in the stream that Write gets
+	framer Framer
+
+	// Whether the current WebSocket connection negotiated compression, which
+	// a reconnect can change
+	compressed atomic.Bool
+
+	// Guarded by its own mutex, since Read and Write dump concurrently
+	frameDump   io.Writer
+	frameDumpMu sync.Mutex
+
+	// Metrics hooks, each only called by the side (Read or Write) it belongs to
+	onRead  func(n int)
+	onWrite func(n int)
+
+	// Unix time in nanoseconds of the last successful Read or Write
+	lastActivity atomic.Int64
+
+	bytesRead            atomic.Int64
+	bytesWritten         atomic.Int64
+	messagesRead         atomic.Int64
+	messagesWritten      atomic.Int64
+	kafkaMessagesWritten atomic.Int64
+
+	// In reconnect mode, dials a replacement for a failed connection. Redials
+	// are serialized, so that a Read and Write that fail at the same time
+	// only replace the connection once
+	redial   func(ctx context.Context) (*websocket.Conn, bool, error)
+	redialMu sync.Mutex
+	closed   atomic.Bool
+
+	// Held for the duration of Close, so that only the first call closes the
+	// connection. Later calls wait for it to finish, and then do nothing
+	closeMu   sync.Mutex
+	closeDone bool
+
+	logger *slog.Logger
+}
+
+// Wraps a WebSocket connection that was established elsewhere (such as one
+// that already went through an authentication exchange) in a Conn, with the
+// default config. The URL of the Conn is built from the remote address, since
+// the URL that was dialed isn't known
+func NewConn(ws *websocket.Conn) net.Conn {
+	c := &Conn{
+		ws:         ws,
+		url:        url.URL{Scheme: "ws", Host: ws.RemoteAddr().String()},
+		maxMsgSize: DefaultMaxMessageSize,
+		framer:     Int32Framer{},
+		logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	if _, ok := ws.UnderlyingConn().(*tls.Conn); ok {
+		c.url.Scheme = "wss"
+	}
+	c.touch()
+	return c
+}
+
+// Returns the time of the last successful Read or Write, or the time the
+// connection was established if there hasn't been one yet
+func (c *Conn) LastActivity() time.Time {
+	return time.Unix(0, c.lastActivity.Load())
+}
+
+// Counts the data that has flowed over a connection
+type ConnStats struct {
+	// Bytes returned by Read
+	BytesRead int64
+	// Bytes sent to the broker by Write (or Flush in buffered write mode),
+	// which only counts complete Kafka protocol messages (a partial message is
+	// buffered until it's complete)
+	BytesWritten int64
+	// WebSocket messages received from the broker, including one that is
+	// still being read
+	MessagesRead int64
+	// WebSocket messages sent to the broker
+	MessagesWritten int64
+	// Kafka protocol messages sent to the broker. Each WebSocket message
+	// holds one, except in buffered write mode, where Flush sends all the
+	// complete ones in a single WebSocket message, so the ratio to
+	// MessagesWritten shows how well Flush coalesces them
+	KafkaMessagesWritten int64
+}
+
+// Returns the counters for the connection, which carry over reconnects
+func (c *Conn) Stats() ConnStats {
+	return ConnStats{
+		BytesRead:            c.bytesRead.Load(),
+		BytesWritten:         c.bytesWritten.Load(),
+		MessagesRead:         c.messagesRead.Load(),
+		MessagesWritten:      c.messagesWritten.Load(),
+		KafkaMessagesWritten: c.kafkaMessagesWritten.Load(),
+	}
+}
+
+// Reports whether the last successful Read was served from the rest of a
+// WebSocket message that an earlier Read started (the read buffer, or the
+// current message in streaming mode), rather than from a freshly received
+// message. This helps check that the partial read path is being exercised
+func (c *Conn) LastReadFromBuffer() bool {
+	return c.lastReadBuffered.Load()
+}
+
+func (c *Conn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// Returns the current underlying WebSocket connection
+func (c *Conn) current() *websocket.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ws
+}
+
+// Replaces the underlying WebSocket connection with a freshly dialed one, and
+// closes the previous connection. The read and write buffers are preserved, so
+// a partially read WebSocket message can still be drained by Read, and a
+// partially written Kafka protocol message will be sent over the new
+// connection once it is complete. Any read or write deadlines (and the read
+// limit) that were set on the previous connection are applied to the new
+// connection as well
+//
+// Note: Any Kafka requests that were sent over the previous connection but
+// haven't received a response yet are lost, since the broker has no way of
+// sending the response over the new connection. Callers must be prepared to
+// resend these requests (or give up on them), otherwise a client waiting on a
+// correlation ID will wait forever. Similarly, a Read or Write blocked on the
+// previous connection will fail when it is closed, even though subsequent calls
+// will use the new connection
+func (c *Conn) swap(ws *websocket.Conn) error {
+	c.mu.Lock()
+	if err := ws.SetReadDeadline(c.effectiveReadDeadline()); err != nil {
+		c.mu.Unlock()
+		return errors.Wrap(err, "shim: set read deadline failed")
+	}
+	if err := ws.SetWriteDeadline(c.writeDeadline); err != nil {
+		c.mu.Unlock()
+		return errors.Wrap(err, "shim: set write deadline failed")
+	}
+	if c.readLimit > 0 {
+		ws.SetReadLimit(c.readLimit)
+	}
+	prev := c.ws
+	c.ws = ws
+	c.mu.Unlock()
+	// The error is ignored, since reconnect closes prev before redialing
+	prev.Close()
+	return nil
+}
+
+// Calls op with the current WebSocket connection. In reconnect mode, if op
+// fails because the connection failed, the connection is replaced and op is
+// retried once on the new connection. The deadline of the operation also
+// bounds the redial
+func (c *Conn) withReconnect(deadline *time.Time, op func(ws *websocket.Conn) error) error {
+	ws := c.current()
+	err := op(ws)
+	if err == nil || c.redial == nil || !shouldReconnect(err) {
+		return err
+	}
+	c.logger.Debug("websocket failed, reconnecting", "remote_addr", ws.RemoteAddr().String(), "error", err)
+	c.mu.Lock()
+	d := *deadline
+	c.mu.Unlock()
+	if err := c.reconnect(ws, d); err != nil {
+		return err
+	}
+	return op(c.current())
+}
+
+// Replaces prev with a freshly dialed connection, unless prev was already
+// replaced by a concurrent Read or Write
+func (c *Conn) reconnect(prev *websocket.Conn, deadline time.Time) error {
+	c.redialMu.Lock()
+	defer c.redialMu.Unlock()
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	if c.current() != prev {
+		return nil
+	}
+	// Fails a Write that is still using prev, so that it waits here and is
+	// sent again over the new connection, rather than being written to a
+	// connection that the broker has already dropped
+	prev.Close()
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	ws, compressed, err := c.redial(ctx)
+	if err != nil {
+		return errors.Wrap(err, "shim: reconnect failed")
+	}
+	if err := c.swap(ws); err != nil {
+		return errors.Wrap(err, "shim: reconnect failed")
+	}
+	c.compressed.Store(compressed)
+	if c.idleTimeout > 0 {
+		c.watchIdle(ws)
+	}
+	if c.closed.Load() {
+		// Close raced with the redial, and may have missed the new connection
+		ws.Close()
+		return net.ErrClosed
+	}
+	return nil
+}
+
+// Reports whether err means the connection failed, rather than being closed
+// normally by the broker, timing out, or exceeding the read limit
+func shouldReconnect(err error) bool {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure) || err == websocket.ErrReadLimit {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	return true
 }
 
 func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	return c.guardRead(func() (int, error) {
+		return c.read(b)
+	})
+}
+
+// Runs a read, failing it with ErrConnClosed if the connection was closed, and
+// recording the bytes read. Must be called with readMu held
+func (c *Conn) guardRead(read func() (int, error)) (int, error) {
+	if c.closed.Load() {
+		return 0, errors.Wrap(ErrConnClosed, "shim: read websocket message failed")
+	}
+	n, err := read()
+	if err != nil && c.closed.Load() {
+		// The read failed because Close closed the connection out from under it
+		return n, errors.Wrap(ErrConnClosed, "shim: read websocket message failed")
+	}
+	if err == nil {
+		c.bytesRead.Add(int64(n))
+		c.touch()
+		if c.idleTimeout > 0 {
+			c.extendIdle(c.current())
+		}
+	}
+	return n, err
+}
+
+// Implements io.WriterTo, which io.Copy uses to copy from the connection.
+// Each WebSocket message is written to w with a single Write, straight from
+// the read buffer, so that w sees whole Kafka protocol messages (unless the
+// message was partially read already, or in streaming mode, where messages
+// are written in the chunks they arrive in). Copies until the broker closes
+// the connection normally, which isn't an error, or a read or write fails.
+// Other Reads wait until the copy is done
+func (c *Conn) WriteTo(w io.Writer) (int64, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	var written int64
+	var chunk []byte
+	for {
+		var p []byte
+		_, err := c.guardRead(func() (int, error) {
+			if c.streamReads {
+				if chunk == nil {
+					chunk = make([]byte, 32<<10)
+				}
+				n, err := c.read(chunk)
+				p = chunk[:n]
+				return n, err
+			}
+			if len(c.rBuf) == 0 {
+				// Reads the next message into the read buffer
+				if _, err := c.read(nil); err != nil {
+					return 0, err
+				}
+			}
+			p, c.rBuf = c.rBuf, nil
+			return len(p), nil
+		})
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(p)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// Implements io.ReaderFrom, which io.Copy uses to copy to the connection. The
+// Kafka protocol messages are read from r one at a time, using their size
+// headers, and each one is passed to Write whole. This sends each message
+// without copying it into the write buffer first. Copies until r returns
+// io.EOF, which isn't an error. A partial message at the end of r is written
+// like any other partial message, and held until the rest of it is written.
+// With a Framer other than Int32Framer, or when an earlier Write left part of
+// a message buffered (so r doesn't start with a size header), r is copied to
+// Write in chunks instead
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	if _, ok := c.framer.(Int32Framer); !ok || c.writePending() {
+		// Hides ReadFrom from io.Copy, which would call it again
+		return io.Copy(struct{ io.Writer }{c}, r)
+	}
+	var read int64
+	var msg []byte
+	for {
+		var header [int32Size]byte
+		n, err := io.ReadFull(r, header[:])
+		if err != nil {
+			return read + int64(n), c.finishReadFrom(header[:n], err)
+		}
+		read += int64(n)
+		size := binary.BigEndian.Uint32(header[:])
+		if uint64(size) > uint64(c.maxMsgSize) {
+			// Write fails the same way, without reading the body. The error
+			// is returned even if Write somehow took the header, since the
+			// body is left unread
+			if _, err := c.Write(header[:]); err != nil {
+				return read, err
+			}
+			return read, OversizedFrameError{Size: size, Max: c.maxMsgSize}
+		}
+		msg = append(msg[:0], header[:]...)
+		msg, err = readBody(r, msg, int(size))
+		read += int64(len(msg) - int32Size)
+		if err != nil {
+			return read, c.finishReadFrom(msg, err)
+		}
+		if _, err := c.Write(msg); err != nil {
+			return read, err
+		}
+	}
+}
+
+// Returns whether the write buffer holds part of a Kafka protocol message
+func (c *Conn) writePending() bool {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return len(c.wBuf) > c.wComplete
+}
+
+// Reads size bytes from r onto the end of msg. The buffer is grown as the
+// bytes arrive, rather than to the size up front, so that a size header that
+// overstates the message doesn't allocate memory for bytes that never come
+func readBody(r io.Reader, msg []byte, size int) ([]byte, error) {
+	for end := len(msg) + size; len(msg) < end; {
+		if len(msg) == cap(msg) {
+			msg = append(msg, 0)[:len(msg)]
+		}
+		n, err := io.ReadFull(r, msg[len(msg):min(end, cap(msg))])
+		msg = msg[:len(msg)+n]
+		if err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
+
+// Writes the partial message that ReadFrom read before r ran out, and returns
+// the error to end the copy with
+func (c *Conn) finishReadFrom(partial []byte, err error) error {
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if len(partial) > 0 {
+		if _, err := c.Write(partial); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads like Read, but gives up once ctx is done, which lets a caller cancel a
+// blocked fetch. The deadline set with SetReadDeadline is restored afterwards,
+// unless another goroutine sets a new one during the read
+//
+// Note: Like a read that times out, a read that is cancelled leaves the
+// connection unusable, since part of a WebSocket message may have been read
+func (c *Conn) ReadContext(ctx context.Context, b []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	prev, gen := c.readDeadline, c.readDeadlineGen
+	c.mu.Unlock()
+	if deadline, ok := ctx.Deadline(); ok && (prev.IsZero() || deadline.Before(prev)) {
+		var err error
+		if gen, err = c.setReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+	// Cancellation without a deadline unblocks the read the same way
+	cancelled := make(chan struct{})
+	cancelGen := gen
+	stop := context.AfterFunc(ctx, func() {
+		defer close(cancelled)
+		cancelGen, _ = c.setReadDeadline(time.Now())
+	})
+	n, err := c.Read(b)
+	if !stop() {
+		// Wait for the deadline to be set, so that it doesn't overwrite the
+		// restored deadline
+		<-cancelled
+		gen = cancelGen
+	}
+	// A deadline set by another goroutine during the read is kept, rather
+	// than replaced by the one from before it
+	if err := c.restoreReadDeadline(prev, gen); err != nil {
+		return n, err
+	}
+	if err != nil {
+		// The read can time out on the deadline just before the context
+		// itself reports that it expired
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return n, errors.Wrap(context.DeadlineExceeded, "shim: read websocket message failed")
+		}
+		if ctx.Err() != nil {
+			return n, errors.Wrap(ctx.Err(), "shim: read websocket message failed")
+		}
+	}
+	return n, err
+}
+
+func (c *Conn) read(b []byte) (int, error) {
+	if c.streamReads {
+		return c.readStream(b)
+	}
 	if len(c.rBuf) > 0 {
 		// If we've buffered the remainder of a WebSocket message that was
 		// partially read, read from this buffer first. We don't make another
 		// read call to the underlying WebSocket until this buffer is empty,
 		// meaning the previous message has been fully read
+		//
+		// A WebSocket message that holds several Kafka protocol messages (from
+		// a broker that batches responses) is handled the same way, since the
+		// client splits the stream using the size headers, not the Reads
 		n := copy(b, c.rBuf)
 		c.rBuf = c.rBuf[n:]
+		c.lastReadBuffered.Store(true)
 		return n, nil
 	}
-	msgType, bytes, err := c.ws.ReadMessage()
-	if err != nil {
-		return 0, errors.Wrap(err, "shim: read websocket message failed")
+	var msg []byte
+	var prefixLen int
+	for {
+		var msgType int
+		var r io.Reader
+		err := c.withReconnect(&c.readDeadline, func(ws *websocket.Conn) error {
+			c.applyReadLimit(ws)
+			var err error
+			msgType, r, err = ws.NextReader()
+			if err != nil || msgType != websocket.BinaryMessage {
+				return err
+			}
+			msg, prefixLen, err = c.readMessage(r)
+			return err
+		})
+		if err != nil {
+			return 0, readError(err)
+		}
+		if msgType != websocket.BinaryMessage {
+			return 0, c.messageTypeError(msgType, r)
+		}
+		drop, err := c.injectFault()
+		if err != nil {
+			return 0, err
+		}
+		if !drop {
+			break
+		}
 	}
-	if msgType != websocket.BinaryMessage {
-		return 0, InvalidMessageTypeError(msgType)
+	c.messagesRead.Add(1)
+	if c.frameDump != nil {
+		c.dumpFrame("recv", msg[prefixLen:])
 	}
-	n := copy(b, bytes)
-	c.rBuf = bytes[n:]
+	if c.onRead != nil {
+		c.onRead(len(msg) - prefixLen)
+	}
+	n := copy(b, msg)
+	c.rBuf = msg[n:]
+	c.lastReadBuffered.Store(false)
 	return n, nil
 }
 
+// Reads a WebSocket message into the message buffer, which is reused from one
+// message to the next, instead of allocating a new buffer for every message.
+// The read buffer points into it, so it's only reused once the read buffer is
+// empty. A buffer that grew past maxReusedReadBuffer for a large message is
+// dropped instead, so that one large message doesn't pin its memory for the
+// life of the connection. Returns the message, along with the length of the
+// prefix that was added to it if prefixes are stripped from the wire
+func (c *Conn) readMessage(r io.Reader) ([]byte, int, error) {
+	if c.msgBuf.Cap() > maxReusedReadBuffer {
+		c.msgBuf = bytes.Buffer{}
+	}
+	c.msgBuf.Reset()
+	var scratch [int32Size]byte
+	room := 0
+	if c.stripHeader {
+		// Leave room for the longest prefix, which is filled in once the
+		// length of the message is known
+		reserved := c.framer.WriteFrame(scratch[:0], math.MaxInt32)
+		room = len(reserved)
+		c.msgBuf.Write(reserved)
+	}
+	if _, err := c.msgBuf.ReadFrom(r); err != nil {
+		return nil, 0, err
+	}
+	msg := c.msgBuf.Bytes()
+	if !c.stripHeader {
+		return msg, 0, nil
+	}
+	prefix := c.framer.WriteFrame(scratch[:0], len(msg)-room)
+	if len(prefix) > room {
+		// A framer that breaks its contract costs a copy
+		return append(prefix, msg[room:]...), len(prefix), nil
+	}
+	start := room - len(prefix)
+	copy(msg[start:], prefix)
+	return msg[start:], len(prefix), nil
+}
+
+// Reads the current WebSocket message directly into b, moving on to the next
+// message once the current message has been fully read
+//
+// Note: A message that is partially read when swap is called can't be finished,
+// since its reader belongs to the previous connection
+func (c *Conn) readStream(b []byte) (int, error) {
+	for {
+		buffered := c.r != nil
+		if c.r == nil {
+			// A failure partway through a message isn't retried, since the
+			// start of the message has already been returned to the caller
+			var msgType int
+			var r io.Reader
+			err := c.withReconnect(&c.readDeadline, func(ws *websocket.Conn) error {
+				var err error
+				c.applyReadLimit(ws)
+				msgType, r, err = ws.NextReader()
+				return err
+			})
+			if err != nil {
+				return 0, readError(err)
+			}
+			if msgType != websocket.BinaryMessage {
+				return 0, c.messageTypeError(msgType, r)
+			}
+			drop, err := c.injectFault()
+			if err != nil {
+				return 0, err
+			}
+			if drop {
+				continue
+			}
+			c.messagesRead.Add(1)
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if c.frameDump != nil && n > 0 {
+			c.dumpFrame("recv", b[:n])
+		}
+		if c.onRead != nil && n > 0 {
+			c.onRead(n)
+		}
+		if err == io.EOF {
+			// The current message has been fully read, so the next call
+			// starts a new message. Don't return an empty read, since callers
+			// could mistake it for the end of the stream
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			c.lastReadBuffered.Store(buffered)
+			return n, nil
+		}
+		if err != nil {
+			return n, readError(err)
+		}
+		if n > 0 || len(b) == 0 {
+			c.lastReadBuffered.Store(buffered)
+			return n, nil
+		}
+	}
+}
+
+// Returns the error for a message of a type other than binary, which in
+// StrictBinary mode includes the start of a text message read from r
+func (c *Conn) messageTypeError(msgType int, r io.Reader) error {
+	if !c.strictBinary || msgType != websocket.TextMessage {
+		return InvalidMessageTypeError(msgType)
+	}
+	// The read error is ignored, since the type is what's wrong either way
+	payload, _ := io.ReadAll(io.LimitReader(r, maxTextPayload+1))
+	return TextMessageError{
+		Payload:   string(payload[:min(len(payload), maxTextPayload)]),
+		Truncated: len(payload) > maxTextPayload,
+	}
+}
+
+// Returns io.EOF if the WebSocket connection was closed normally by the other
+// side, so that callers can tell a graceful close apart from a failure, just
+// like they would with a TCP connection. Other close codes are returned as
+// ShimCloseError
+func readError(err error) error {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		return io.EOF
+	}
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return ShimCloseError{Code: closeErr.Code, Reason: closeErr.Text}
+	}
+	return errors.Wrap(err, "shim: read websocket message failed")
+}
+
 func (c *Conn) Write(b []byte) (int, error) {
-	written := -len(c.wBuf)
-	c.wBuf = append(c.wBuf, b...)
-	for len(c.wBuf) > 0 {
-		if len(c.wBuf) < int32Size {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed.Load() {
+		return 0, errors.Wrap(ErrConnClosed, "shim: write websocket message failed")
+	}
+	if c.queue != nil && c.queue.full() {
+		return 0, ErrWriteQueueFull
+	}
+	n, err := c.write(b)
+	if err != nil && c.closed.Load() {
+		return n, errors.Wrap(ErrConnClosed, "shim: write websocket message failed")
+	}
+	if err == nil {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *Conn) write(b []byte) (int, error) {
+	if c.wErr != nil {
+		return 0, c.wErr
+	}
+	if c.bufferWrites {
+		return c.bufferWrite(b)
+	}
+	prev := len(c.wBuf)
+	written := -prev
+	// Complete messages are sent straight from b if nothing was left in the
+	// write buffer by an earlier write, which saves copying them into it
+	buf := b
+	buffered := len(c.wBuf) > 0
+	if buffered {
+		c.wBuf = append(c.wBuf, b...)
+		buf = c.wBuf
+	}
+	// The messages that were sent are dropped from the write buffer on the
+	// way out, by moving whatever is left to the front, so that the next write
+	// reuses the backing array instead of growing a new one. If the write
+	// fails, the bytes of b that weren't sent are dropped rather than kept,
+	// since n tells the caller they weren't written
+	sent := 0
+	failed := false
+	defer func() {
+		switch {
+		case buffered && failed:
+			c.wBuf = c.wBuf[:copy(c.wBuf, c.wBuf[min(sent, prev):prev])]
+		case buffered:
+			c.wBuf = c.wBuf[:copy(c.wBuf, c.wBuf[sent:])]
+		case !failed:
+			c.wBuf = append(c.wBuf, b[sent:]...)
+		}
+	}()
+	for len(buf[sent:]) > 0 {
+		rest := buf[sent:]
+		prefixLen, size, err := c.nextFrame(rest)
+		if err == io.ErrUnexpectedEOF {
 			return len(b), nil
 		}
-		size := int32(binary.BigEndian.Uint32(c.wBuf))
-		if len(c.wBuf[int32Size:]) < int(size) {
+		if err != nil {
+			c.wErr = err
+			failed = true
+			return max(written, 0), err
+		}
+		if len(rest[prefixLen:]) < size {
+			if err := c.checkWriteBuffer(rest); err != nil {
+				failed = true
+				return max(written, 0), err
+			}
 			return len(b), nil
 		}
-		totalSize := int32Size + int(size)
+		totalSize := prefixLen + size
 		// For now, we send each Kafka protocol message in its own WebSocket
 		// message, even if multiple protocol messages are included in the same
 		// write call. We could optimize this my by allowing multiple protocol
@@ -120,41 +1642,428 @@ func (c *Conn) Write(b []byte) (int, error) {
 		// the size header anyway to match the Kafka protocol spec as closely as
 		// possible, knowing that we should be able to ditch the shim and use
 		// TCP directly in the future. For now, we want to avoid any protocol
-		// modifications that are specific to WebSocket usage
-		if err := c.ws.WriteMessage(websocket.BinaryMessage, c.wBuf[:totalSize]); err != nil {
-			return max(written, 0), errors.Wrap(err, "shim: write websocket message failed")
+		// modifications that are specific to WebSocket usage, unless the
+		// header is stripped explicitly
+		msg := rest[:totalSize]
+		if c.stripHeader {
+			msg = msg[prefixLen:]
+		}
+		if err := c.sendMessage(msg, 1); err != nil {
+			failed = true
+			return max(written, 0), err
 		}
 		written += totalSize
-		c.wBuf = c.wBuf[totalSize:]
+		sent += totalSize
 	}
 	return max(written, 0), nil
 }
 
+// Appends b to the write buffer without sending anything, keeping track of the
+// complete Kafka protocol messages that are ready to be sent by Flush
+func (c *Conn) bufferWrite(b []byte) (int, error) {
+	// None of b is kept if the write fails, including any messages it
+	// completed before the one that failed
+	prev, complete, msgs := len(c.wBuf), c.wComplete, c.wCompleteMsgs
+	reject := func(err error) (int, error) {
+		c.wBuf, c.wComplete, c.wCompleteMsgs = c.wBuf[:prev], complete, msgs
+		return 0, err
+	}
+	c.wBuf = append(c.wBuf, b...)
+	for {
+		rest := c.wBuf[c.wComplete:]
+		if len(rest) == 0 {
+			return len(b), nil
+		}
+		prefixLen, size, err := c.nextFrame(rest)
+		if err == io.ErrUnexpectedEOF {
+			return len(b), nil
+		}
+		if err != nil {
+			c.wErr = err
+			return reject(err)
+		}
+		if len(rest[prefixLen:]) < size {
+			if err := c.checkWriteBuffer(rest); err != nil {
+				return reject(err)
+			}
+			return len(b), nil
+		}
+		c.wComplete += prefixLen + size
+		c.wCompleteMsgs++
+	}
+}
+
+// Reads the prefix of the message at the start of rest with the framer,
+// returning io.ErrUnexpectedEOF if the prefix isn't complete yet. Fails if the
+// message is larger than the limit, or the prefix is malformed
+func (c *Conn) nextFrame(rest []byte) (int, int, error) {
+	prefixLen, size, err := c.framer.ReadFrame(rest)
+	if err == io.ErrUnexpectedEOF {
+		return 0, 0, err
+	}
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "shim: read message prefix failed")
+	}
+	if size <= 0 {
+		return 0, 0, InvalidFrameSizeError{Size: size}
+	}
+	if size > c.maxMsgSize {
+		return 0, 0, OversizedFrameError{Size: uint32(min(int64(size), math.MaxUint32)), Max: c.maxMsgSize}
+	}
+	return prefixLen, size, nil
+}
+
+// Returns an error if the partial Kafka protocol message at the end of the
+// write buffer is larger than the write buffer limit
+func (c *Conn) checkWriteBuffer(partial []byte) error {
+	if c.maxWriteBuf > 0 && len(partial) > c.maxWriteBuf {
+		return WriteBufferFullError{Size: len(partial), Max: c.maxWriteBuf}
+	}
+	return nil
+}
+
+// Sends the complete Kafka protocol messages held by Write in buffered write
+// mode, as a single WebSocket message. A partial message stays buffered until
+// it's complete. Does nothing if there are no complete messages
+func (c *Conn) Flush() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed.Load() {
+		return errors.Wrap(ErrConnClosed, "shim: write websocket message failed")
+	}
+	return c.flush()
+}
+
+func (c *Conn) flush() error {
+	if c.wComplete == 0 {
+		return nil
+	}
+	if err := c.sendMessage(c.wBuf[:c.wComplete], c.wCompleteMsgs); err != nil {
+		return err
+	}
+	c.wBuf = c.wBuf[:copy(c.wBuf, c.wBuf[c.wComplete:])]
+	c.wComplete = 0
+	c.wCompleteMsgs = 0
+	c.touch()
+	return nil
+}
+
+// Sends p, which holds kafkaMsgs Kafka protocol messages, to the broker in a
+// single WebSocket message, or hands it to the write queue in async write
+// mode. Must be called with writeMu held
+func (c *Conn) sendMessage(p []byte, kafkaMsgs int) error {
+	if c.queue != nil {
+		return c.queue.enqueue(p, kafkaMsgs)
+	}
+	return c.writeMessage(p, kafkaMsgs)
+}
+
+// Sends p, which holds kafkaMsgs Kafka protocol messages, to the broker in a
+// single WebSocket message, applying the write deadline and timeout. Must be
+// called with writeMu held, or by the writer goroutine in async write mode,
+// which is the only sender then
+func (c *Conn) writeMessage(p []byte, kafkaMsgs int) error {
+	if c.writeLimiter != nil {
+		if err := c.writeLimiter.wait(len(p), c.messageWriteDeadline()); err != nil {
+			return errors.Wrap(err, "shim: write websocket message failed")
+		}
+	}
+	if drop, err := c.injectFault(); drop || err != nil {
+		return err
+	}
+	err := c.withReconnect(&c.writeDeadline, func(ws *websocket.Conn) error {
+		// The WebSocket connection applies its write deadline itself when
+		// sending, so it's only set here, where it can't race with a send
+		if err := ws.SetWriteDeadline(c.messageWriteDeadline()); err != nil {
+			return errors.Wrap(err, "shim: set write deadline failed")
+		}
+		return ws.WriteMessage(websocket.BinaryMessage, p)
+	})
+	if err != nil {
+		return errors.Wrap(err, "shim: write websocket message failed")
+	}
+	if c.frameDump != nil {
+		c.dumpFrame("send", p)
+	}
+	if c.onWrite != nil {
+		c.onWrite(len(p))
+	}
+	c.bytesWritten.Add(int64(len(p)))
+	c.messagesWritten.Add(1)
+	c.kafkaMessagesWritten.Add(int64(kafkaMsgs))
+	return nil
+}
+
+// Applies the configured faults to the next WebSocket message, returning
+// whether the message should be dropped, or an error if the connection was
+// disconnected
+func (c *Conn) injectFault() (bool, error) {
+	if c.faults == nil {
+		return false, nil
+	}
+	switch c.faults.next() {
+	case faultDisconnect:
+		c.current().Close()
+		return false, ErrInjectedDisconnect
+	case faultDrop:
+		return true, nil
+	}
+	return false, nil
+}
+
+// Writes a hex dump of p to the frame dump, tagged with the direction
+func (c *Conn) dumpFrame(dir string, p []byte) {
+	c.frameDumpMu.Lock()
+	defer c.frameDumpMu.Unlock()
+	fmt.Fprintf(c.frameDump, "%s %d bytes\n%s", dir, len(p), hex.Dump(p))
+}
+
+// Sends a close message to the broker before closing, so that the broker sees
+// a normal closure. In buffered write mode, the complete Kafka protocol
+// messages held by Write are flushed first, and in async write mode, the
+// queued messages are sent first. The connection is closed even if
+// the flush fails. Only the first call closes the connection, and later calls
+// (including concurrent ones) return nil
 func (c *Conn) Close() error {
-	return c.ws.Close()
+	return c.CloseContext(context.Background())
+}
+
+// Closes the connection like Close, but gives up on the flush and the close
+// message once ctx is done, which bounds the time spent on a broker that has
+// stopped reading. The connection is closed either way. If ctx has no
+// deadline, sending the close message is still bounded by a second
+func (c *Conn) CloseContext(ctx context.Context) error {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closeDone {
+		return nil
+	}
+	c.closeDone = true
+	// Closing the underlying connection unblocks the flush or close message
+	stop := context.AfterFunc(ctx, func() {
+		c.current().Close()
+	})
+	defer stop()
+	var flushErr error
+	if c.bufferWrites {
+		flushErr = c.Flush()
+	}
+	if c.queue != nil {
+		c.writeMu.Lock()
+		if err := c.queue.close(); err != nil && flushErr == nil {
+			flushErr = err
+		}
+		// Set while holding writeMu, so that no Write queues a message
+		// once the queue is closed
+		c.closed.Store(true)
+		c.writeMu.Unlock()
+	}
+	// Stops a Read or Write that fails because of the close from reconnecting
+	c.closed.Store(true)
+	ws := c.current()
+	c.logger.Debug("closing websocket", "remote_addr", ws.RemoteAddr().String())
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(closeTimeout)
+	}
+	// Best effort, since the connection may have failed already
+	err := ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+	var netErr net.Error
+	if ok && errors.As(err, &netErr) && netErr.Timeout() {
+		// WriteControl gives up at the deadline of ctx, which can be just
+		// before ctx is done
+		<-ctx.Done()
+	}
+	if stopped := stop(); !stopped || ctx.Err() != nil {
+		if stopped {
+			ws.Close()
+		}
+		return errors.Wrap(ctx.Err(), "shim: close websocket failed")
+	}
+	if err := ws.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// Returns whether the connection can be handed to another user, which needs
+// it to be open and between messages in both directions
+func (c *Conn) reusable() bool {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return !c.closed.Load() && len(c.rBuf) == 0 && c.r == nil && len(c.wBuf) == 0
+}
+
+// Returns the underlying WebSocket connection, for calling the methods that
+// Conn doesn't wrap, such as SetPingHandler. In reconnect mode, the
+// connection is replaced when it fails, and settings made on the previous one
+// don't carry over
+//
+// Note: Reading or writing data messages directly on the WebSocket
+// connection bypasses the framing (and the read and write buffers) of Conn,
+// which corrupts the Kafka protocol stream. Stick to settings and control
+// messages
+func (c *Conn) Raw() *websocket.Conn {
+	return c.current()
+}
+
+// Returns the URL of the WebSocket connection, including the scheme (ws:// or
+// wss://) and the broker host, which RemoteAddr doesn't convey. For connections
+// accepted by Upgrader, this is the URL that the client requested
+func (c *Conn) URL() *url.URL {
+	u := c.url
+	return &u
+}
+
+// Reports whether the connection is compressed, which is only the case if
+// compression was enabled and the other side agreed to it. In reconnect mode,
+// this reflects the current connection
+func (c *Conn) Compressed() bool {
+	return c.compressed.Load()
 }
 
 func (c *Conn) LocalAddr() net.Addr {
-	return c.ws.LocalAddr()
+	return c.current().LocalAddr()
 }
 
 func (c *Conn) RemoteAddr() net.Addr {
-	return c.ws.RemoteAddr()
+	return c.current().RemoteAddr()
 }
 
 func (c *Conn) SetDeadline(t time.Time) error {
+	// Deadlines are recorded so that swap can apply them to the new connection
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.readDeadlineGen++
+	c.writeDeadline = t
 	// For some reason there is no c.ws.SetDeadline(t)
-	return c.ws.UnderlyingConn().SetDeadline(t)
+	if err := c.ws.UnderlyingConn().SetDeadline(t); err != nil {
+		return err
+	}
+	if c.idleTimeout > 0 {
+		return c.ws.SetReadDeadline(c.effectiveReadDeadline())
+	}
+	return nil
 }
 
+// Safe to call while a Read is blocked, which makes the Read fail once the
+// deadline passes
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	_, err := c.setReadDeadline(t)
+	return err
+}
+
+// Returns the generation of the read deadline that was set
+func (c *Conn) setReadDeadline(t time.Time) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.readDeadlineGen++
 	// Equivalent to c.ws.UnderlyingConn().SetReadDeadline(t)
-	return c.ws.SetReadDeadline(t)
+	return c.readDeadlineGen, c.ws.SetReadDeadline(c.effectiveReadDeadline())
+}
+
+// Sets the read deadline back to t, unless it was set again since the
+// generation gen
+func (c *Conn) restoreReadDeadline(t time.Time, gen uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readDeadlineGen != gen {
+		return nil
+	}
+	c.readDeadline = t
+	return c.ws.SetReadDeadline(c.effectiveReadDeadline())
+}
+
+// Returns the read deadline, or the idle deadline if it comes first. Must be
+// called with mu held
+func (c *Conn) effectiveReadDeadline() time.Time {
+	if c.idleTimeout == 0 {
+		return c.readDeadline
+	}
+	idle := time.Now().Add(c.idleTimeout)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(idle) {
+		return c.readDeadline
+	}
+	return idle
+}
+
+// Pushes back the idle deadline of ws, since something was just received
+func (c *Conn) extendIdle(ws *websocket.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ws.SetReadDeadline(c.effectiveReadDeadline())
 }
 
+// Starts the idle timeout for ws, and pings the broker until ws is closed so
+// that a healthy broker always has something to send
+func (c *Conn) watchIdle(ws *websocket.Conn) {
+	ws.SetPongHandler(func(string) error {
+		c.extendIdle(ws)
+		return nil
+	})
+	c.extendIdle(ws)
+	go func() {
+		t := time.NewTicker(c.idleTimeout / 2)
+		defer t.Stop()
+		for range t.C {
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.idleTimeout)); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Safe to call while a Write is blocked, which makes the Write fail once the
+// deadline passes
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	// Equivalent to c.ws.UnderlyingConn().SetWriteDeadline(t)
-	return c.ws.SetWriteDeadline(t)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	// The WebSocket connection's own write deadline is applied by the next
+	// Write, and setting it here would race with a Write in progress
+	return c.ws.UnderlyingConn().SetWriteDeadline(t)
+}
+
+// Returns the write deadline, or the write timeout if it comes first
+func (c *Conn) messageWriteDeadline() time.Time {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if c.writeTimeout == 0 {
+		return deadline
+	}
+	timeout := time.Now().Add(c.writeTimeout)
+	if deadline.IsZero() || timeout.Before(deadline) {
+		return timeout
+	}
+	return deadline
+}
+
+// Sets the maximum size in bytes of a WebSocket message read from the broker,
+// which can be changed at any time (such as when a client moves on from small
+// metadata requests to large fetches). Reading a larger message fails with
+// websocket.ErrReadLimit, and closes the connection. No limit is applied if
+// zero, which is the default
+//
+// Note: The limit takes effect from the next message that Read starts, since
+// the WebSocket connection can't change its limit while a read is in progress
+func (c *Conn) SetReadLimit(limit int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readLimit = limit
+}
+
+// Applies the limit set by SetReadLimit to ws, which must only be called by
+// Read
+func (c *Conn) applyReadLimit(ws *websocket.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ws.SetReadLimit(c.readLimit)
 }
 
 func max(a, b int) int {
@@ -1,12 +1,23 @@
 package shim
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
@@ -26,14 +37,42 @@ func (f StopFunc) Stop() {
 	f()
 }
 
-func StartServer(addr string, handler func(*websocket.Conn) error) StopFunc {
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatal(errors.Wrap(err, "server: listen failed"))
+// The in-memory listeners that the tests serve on, by the address that they
+// are dialed with
+var pipes = struct {
+	sync.Mutex
+	listeners map[string]*PipeListener
+}{listeners: map[string]*PipeListener{}}
+
+// Returns an in-memory listener that DialPipe connects to when dialing addr,
+// so that tests don't bind real ports. The address is only a name, which the
+// dialer still puts in the URL of the connection
+func ListenPipe(addr string) *PipeListener {
+	l := NewPipeListener()
+	pipes.Lock()
+	defer pipes.Unlock()
+	pipes.listeners[addr] = l
+	return l
+}
+
+// Connects to the listener returned by ListenPipe for addr. Fails like a
+// refused TCP connection if there isn't one, or it's closed
+func DialPipe(ctx context.Context, network, addr string) (net.Conn, error) {
+	pipes.Lock()
+	l, ok := pipes.listeners[addr]
+	pipes.Unlock()
+	if !ok {
+		return nil, errors.Errorf("dial pipe %s: connection refused", addr)
 	}
+	return l.DialContext(ctx, network, addr)
+}
+
+// Serves WebSocket connections on the in-memory listener for addr, which
+// tests dial by setting DialPipe as DialerConfig.NetDialContext
+func StartServer(addr string, handler func(*websocket.Conn) error) StopFunc {
+	l := ListenPipe(addr)
 	upgrader := websocket.Upgrader{}
 	s := http.Server{
-		Addr: addr,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			c, err := upgrader.Upgrade(w, r, nil)
 			if err != nil {
@@ -51,12 +90,45 @@ func StartServer(addr string, handler func(*websocket.Conn) error) StopFunc {
 		}
 	}()
 	return func() {
-		if err = s.Shutdown(context.Background()); err != nil {
+		if err := s.Shutdown(context.Background()); err != nil {
 			log.Fatal(errors.Wrap(err, "server: shutdown failed"))
 		}
 	}
 }
 
+// Writes back every message received until the client closes the connection.
+// The messages are written back by another goroutine, so that a client can
+// write several messages before reading any of them back, even though writes
+// to a pipe block until the other side reads them
+func EchoHandler(c *websocket.Conn) error {
+	type message struct {
+		mt int
+		p  []byte
+	}
+	echoes := make(chan message, 100)
+	written := make(chan error, 1)
+	go func() {
+		for m := range echoes {
+			if err := c.WriteMessage(m.mt, m.p); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+	for {
+		mt, p, err := c.ReadMessage()
+		if err != nil {
+			close(echoes)
+			// Unblocks a write to a client that stopped reading
+			c.Close()
+			<-written
+			return nil
+		}
+		echoes <- message{mt, p}
+	}
+}
+
 func MakeMsg(length int32, fill byte) []byte {
 	msg := make([]byte, int32Size+length)
 	binary.BigEndian.PutUint32(msg, uint32(length))
@@ -71,6 +143,71 @@ func TestInvalidNetwork(t *testing.T) {
 	c, err := d.Dial("foo", "localhost:7979")
 	assert.Nil(t, c)
 	assert.ErrorIs(t, err, InvalidNetworkError("foo"))
+	c, err = d.Dial("udp", "localhost:7979")
+	assert.Nil(t, c)
+	assert.ErrorIs(t, err, InvalidNetworkError("udp"))
+}
+
+func TestIPv6Address(t *testing.T) {
+	addr := "[::1]:8151"
+	l := ListenPipe(addr)
+	hosts := make(chan string, 1)
+	u := NewUpgrader(UpgraderConfig{})
+	s := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+		c, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	})}
+	go s.Serve(l)
+	defer s.Close()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp6", addr)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+	// The upgrade request names the broker with the brackets
+	assert.Equal(t, addr, <-hosts)
+	wsURL := c.(*Conn).URL()
+	assert.Equal(t, "ws://[::1]:8151", wsURL.String())
+	assert.Equal(t, "::1", wsURL.Hostname())
+	assert.Equal(t, "8151", wsURL.Port())
+
+	_, err = c.Write(msg1)
+	assert.Nil(t, err)
+	buf := make([]byte, len(msg1))
+	_, err = io.ReadFull(c, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg1, buf)
+
+	// Without brackets, the host can't be told apart from the port
+	_, err = d.Dial("tcp", "::1:8151")
+	assert.ErrorContains(t, err, "invalid broker address")
+}
+
+func TestIPNetworks(t *testing.T) {
+	addr := "localhost:8144"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	for _, network := range []string{"tcp4", "tcp6"} {
+		c, err := d.Dial(network, addr)
+		if !assert.Nil(t, err, network) {
+			continue
+		}
+		_, err = c.Write(msg1)
+		assert.Nil(t, err, network)
+		buf := make([]byte, len(msg1))
+		_, err = io.ReadFull(c, buf)
+		assert.Nil(t, err, network)
+		assert.Equal(t, msg1, buf, network)
+		c.Close()
+	}
 }
 
 func TestReadOne(t *testing.T) {
@@ -80,7 +217,7 @@ func TestReadOne(t *testing.T) {
 	}
 	defer StartServer(addr, handler).Stop()
 
-	d := NewDialer(DialerConfig{TLS: false})
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
 	c, err := d.Dial("tcp", addr)
 	assert.Nil(t, err)
 	defer c.Close()
@@ -104,7 +241,7 @@ func TestReadMany(t *testing.T) {
 	}
 	defer StartServer(addr, handler).Stop()
 
-	d := NewDialer(DialerConfig{TLS: false})
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
 	c, err := d.Dial("tcp", addr)
 	assert.Nil(t, err)
 	defer c.Close()
@@ -125,7 +262,7 @@ func TestReadInvalidMessageType(t *testing.T) {
 	}
 	defer StartServer(addr, handler).Stop()
 
-	d := NewDialer(DialerConfig{TLS: false})
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
 	c, err := d.Dial("tcp", addr)
 	assert.Nil(t, err)
 	defer c.Close()
@@ -136,6 +273,39 @@ func TestReadInvalidMessageType(t *testing.T) {
 	assert.Equal(t, 0, n)
 }
 
+func TestStrictBinary(t *testing.T) {
+	addr := "localhost:8150"
+	page := "<html><body><h1>502 Bad Gateway</h1>" + strings.Repeat("<p>upstream unavailable</p>", 20) + "</body></html>"
+	handler := func(c *websocket.Conn) error {
+		c.WriteMessage(websocket.TextMessage, []byte(page))
+		c.WriteMessage(websocket.TextMessage, []byte(page[:20]))
+		c.ReadMessage()
+		return nil
+	}
+	defer StartServer(addr, handler).Stop()
+
+	for _, streamReads := range []bool{false, true} {
+		d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, StrictBinary: true, StreamReads: streamReads})
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+
+		buf := make([]byte, 150)
+		n, err := c.Read(buf)
+		assert.Equal(t, 0, n)
+		assert.ErrorIs(t, err, InvalidMessageTypeError(websocket.TextMessage))
+		var textErr TextMessageError
+		if assert.ErrorAs(t, err, &textErr) {
+			assert.Equal(t, page[:256], textErr.Payload, "payload is truncated")
+			assert.True(t, textErr.Truncated)
+		}
+		assert.Contains(t, err.Error(), "502 Bad Gateway", "payload is in the message")
+
+		_, err = c.Read(buf)
+		assert.Equal(t, TextMessageError{Payload: page[:20]}, err, "short payload isn't truncated")
+		c.Close()
+	}
+}
+
 func TestWriteOne(t *testing.T) {
 	addr := "localhost:8083"
 	handler := func(c *websocket.Conn) error {
@@ -149,7 +319,7 @@ func TestWriteOne(t *testing.T) {
 	}
 	defer StartServer(addr, handler).Stop()
 
-	d := NewDialer(DialerConfig{TLS: false})
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
 	c, err := d.Dial("tcp", addr)
 	assert.Nil(t, err)
 	defer c.Close()
@@ -174,7 +344,7 @@ func TestWriteMany(t *testing.T) {
 	}
 	defer StartServer(addr, handler).Stop()
 
-	d := NewDialer(DialerConfig{TLS: false})
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
 	c, err := d.Dial("tcp", addr)
 	assert.Nil(t, err)
 	defer c.Close()
@@ -206,7 +376,7 @@ func TestWritePartial(t *testing.T) {
 	}
 	defer StartServer(addr, handler).Stop()
 
-	d := NewDialer(DialerConfig{TLS: false})
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
 	c, err := d.Dial("tcp", addr)
 	assert.Nil(t, err)
 	defer c.Close()
@@ -236,3 +406,2715 @@ func TestWritePartial(t *testing.T) {
 	assert.Equal(t, len(msg2)-30, n)
 	assert.Nil(t, err)
 }
+
+func TestSwap(t *testing.T) {
+	addr1 := "localhost:8086"
+	addr2 := "localhost:8087"
+	defer StartServer(addr1, EchoHandler).Stop()
+	// Unlike the first server, the second server replies with msg3 regardless
+	// of what it receives, so we can tell which connection served a request
+	handler := func(c *websocket.Conn) error {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return nil
+			}
+			if err := c.WriteMessage(websocket.BinaryMessage, msg3); err != nil {
+				return err
+			}
+		}
+	}
+	defer StartServer(addr2, handler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr1)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// Write msg1 and read back part of the echo, leaving the rest buffered
+	n, err := c.Write(msg1)
+	assert.Nil(t, err)
+	assert.Equal(t, len(msg1), n)
+	buf := make([]byte, 150)
+	n, err = c.Read(buf[:50])
+	assert.Nil(t, err)
+	assert.Equal(t, 50, n)
+
+	// Write part of msg2, which stays buffered until the message is complete
+	n, err = c.Write(msg2[:30])
+	assert.Nil(t, err)
+	assert.Equal(t, 30, n)
+
+	deadline := time.Now().Add(time.Hour)
+	assert.Nil(t, c.SetReadDeadline(deadline))
+
+	prev := c.(*Conn).current()
+	ws, _, err := (&websocket.Dialer{NetDialContext: DialPipe}).Dial("ws://"+addr2, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, c.(*Conn).swap(ws))
+
+	// The previous connection is closed by swap
+	assert.NotNil(t, prev.WriteMessage(websocket.BinaryMessage, msg1))
+	_, _, err = prev.ReadMessage()
+	assert.NotNil(t, err)
+
+	// Deadlines carry over to the new connection
+	assert.Equal(t, deadline, c.(*Conn).readDeadline)
+
+	// The rest of msg1 is served from the read buffer
+	n, err = c.Read(buf[50:])
+	assert.Nil(t, err)
+	assert.Equal(t, len(msg1)-50, n)
+	assert.Equal(t, msg1, buf[:len(msg1)], "buffer matches message")
+
+	// The rest of msg2 completes the message, which goes to the new connection
+	n, err = c.Write(msg2[30:])
+	assert.Nil(t, err)
+	assert.Equal(t, len(msg2)-30, n)
+	n, err = c.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg3, buf[:n], "buffer matches second server reply")
+}
+
+func TestDialSLO(t *testing.T) {
+	// Accepts TCP connections but never completes the WebSocket upgrade
+	addr := "localhost:8088"
+	l := ListenPipe(addr)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, DialSLO: 100 * time.Millisecond})
+	start := time.Now()
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, c)
+	assert.ErrorIs(t, err, DialSLOError(100*time.Millisecond))
+	assert.Less(t, time.Since(start), time.Second, "dial fails soon after the slo")
+}
+
+func TestStreamReads(t *testing.T) {
+	addr := "localhost:8089"
+	large := MakeMsg(1<<20, 'z')
+	handler := func(c *websocket.Conn) error {
+		if err := c.WriteMessage(websocket.BinaryMessage, large); err != nil {
+			return err
+		}
+		return c.WriteMessage(websocket.BinaryMessage, msg1)
+	}
+	defer StartServer(addr, handler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, StreamReads: true})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// Reassemble the large message from many small reads, checking that none
+	// of it is buffered inside the connection along the way
+	var got bytes.Buffer
+	buf := make([]byte, 1024)
+	for got.Len() < len(large) {
+		n, err := c.Read(buf)
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.LessOrEqual(t, n, len(buf))
+		assert.Nil(t, c.(*Conn).rBuf, "nothing retained in read buffer")
+		got.Write(buf[:n])
+	}
+	assert.Equal(t, large, got.Bytes(), "large message reassembled")
+
+	n, err := c.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg1, buf[:n], "next message starts on next read")
+}
+
+func TestRequireTLS(t *testing.T) {
+	d := NewDialer(DialerConfig{TLS: false, RequireTLS: true})
+	c, err := d.Dial("tcp", "localhost:8090")
+	assert.Nil(t, c)
+	assert.ErrorIs(t, err, InsecureURLError("ws://localhost:8090"))
+
+	// With TLS enabled the dial goes ahead, and fails only because nothing is
+	// listening
+	d = NewDialer(DialerConfig{TLS: true, RequireTLS: true})
+	c, err = d.Dial("tcp", "localhost:8090")
+	assert.Nil(t, c)
+	var insecure InsecureURLError
+	assert.False(t, errors.As(err, &insecure))
+	assert.ErrorContains(t, err, "shim: dial websocket failed")
+}
+
+func TestLastActivity(t *testing.T) {
+	addr := "localhost:8091"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	dialed := c.(*Conn).LastActivity()
+	assert.WithinDuration(t, time.Now(), dialed, time.Second, "starts at dial time")
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, dialed, c.(*Conn).LastActivity(), "stays put while idle")
+
+	_, err = c.Write(msg1)
+	assert.Nil(t, err)
+	written := c.(*Conn).LastActivity()
+	assert.True(t, written.After(dialed), "advances on write")
+
+	time.Sleep(10 * time.Millisecond)
+	_, err = c.Read(make([]byte, 150))
+	assert.Nil(t, err)
+	assert.True(t, c.(*Conn).LastActivity().After(written), "advances on read")
+}
+
+func TestReconnect(t *testing.T) {
+	addr := "localhost:8092"
+	// The first connection is dropped without a close message, as if the
+	// broker went away. Later connections send msg1 unprompted, and then echo
+	var dials atomic.Int32
+	handler := func(c *websocket.Conn) error {
+		if dials.Add(1) == 1 {
+			return nil
+		}
+		if err := c.WriteMessage(websocket.BinaryMessage, msg1); err != nil {
+			return err
+		}
+		return EchoHandler(c)
+	}
+	defer StartServer(addr, handler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, Reconnect: true})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+
+	// The read fails on the first connection, and is retried on the second
+	buf := make([]byte, 150)
+	n, err := c.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg1, buf[:n], "buffer matches message from second connection")
+	assert.Equal(t, int32(2), dials.Load())
+
+	_, err = c.Write(msg2)
+	assert.Nil(t, err)
+	n, err = c.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg2, buf[:n], "buffer matches echo")
+
+	// Closing the connection doesn't trigger a reconnect
+	assert.Nil(t, c.Close())
+	_, err = c.Read(buf)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(2), dials.Load())
+}
+
+func TestTraceDial(t *testing.T) {
+	// Dials over TCP, by host name, since the DNS and connect phases are
+	// traced by the net package. The port is picked by the OS
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	assert.Nil(t, err)
+	addr := net.JoinHostPort("localhost", port)
+	// Delays the WebSocket upgrade, so the upgrade phase should dominate
+	delay := 50 * time.Millisecond
+	upgrader := websocket.Upgrader{}
+	s := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		EchoHandler(c)
+		c.Close()
+	})}
+	go s.Serve(l)
+	defer s.Close()
+
+	var timing DialTiming
+	var traceErr error
+	d := NewDialer(DialerConfig{TLS: false, TraceDial: func(t DialTiming, err error) {
+		timing = t
+		traceErr = err
+	}})
+	start := time.Now()
+	c, err := d.Dial("tcp", addr)
+	total := time.Since(start)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	assert.Nil(t, traceErr)
+	assert.Greater(t, timing.DNS, time.Duration(0), "dns phase captured")
+	assert.Greater(t, timing.Connect, time.Duration(0), "connect phase captured")
+	assert.Zero(t, timing.TLSHandshake, "no tls handshake")
+	assert.GreaterOrEqual(t, timing.Upgrade, delay, "upgrade phase captured")
+	assert.LessOrEqual(t, timing.Total, total)
+
+	// The phases don't overlap, and cover almost all of the dial
+	sum := timing.DNS + timing.Connect + timing.TLSHandshake + timing.Upgrade
+	assert.LessOrEqual(t, sum, timing.Total)
+	assert.Less(t, timing.Total-sum, 10*time.Millisecond, "phases sum to roughly the total")
+}
+
+func TestTraceDialFailure(t *testing.T) {
+	var traceErr error
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, TraceDial: func(t DialTiming, err error) {
+		traceErr = err
+	}})
+	_, err := d.Dial("tcp", "localhost:7979")
+	assert.NotNil(t, err)
+	assert.Equal(t, err, traceErr)
+}
+
+func TestDialRetry(t *testing.T) {
+	addr := "localhost:8094"
+	// Rejects the first two dials, as if the broker were still starting up
+	var dials atomic.Int32
+	l := ListenPipe(addr)
+	upgrader := websocket.Upgrader{}
+	s := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dials.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		EchoHandler(c)
+		c.Close()
+	})}
+	go s.Serve(l)
+	defer s.Close()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, RetryCount: 1, RetryBackoff: 10 * time.Millisecond})
+	_, err := d.Dial("tcp", addr)
+	assert.NotNil(t, err, "fails when out of retries")
+	assert.Equal(t, int32(2), dials.Load())
+
+	dials.Store(0)
+	d = NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, RetryCount: 2, RetryBackoff: 10 * time.Millisecond})
+	start := time.Now()
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Equal(t, int32(3), dials.Load())
+	assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond, "backoff doubles")
+
+	dials.Store(0)
+	d = NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, RetryCount: 2, RetryBackoff: 10 * time.Millisecond, RetryMultiplier: 5})
+	start = time.Now()
+	c2, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c2.Close()
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond, "backoff grows by the multiplier")
+
+	// Cancellation cuts the backoff short
+	dials.Store(0)
+	d = NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, RetryCount: 2, RetryBackoff: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = d.DialContext(ctx, "tcp", addr)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int32(1), dials.Load())
+}
+
+func TestDialerLogger(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, Logger: logger})
+	_, err := d.Dial("tcp", "localhost:7979")
+	assert.NotNil(t, err)
+	assert.Contains(t, logs.String(), `level=DEBUG msg="dialing websocket" url=ws://localhost:7979`)
+	assert.Contains(t, logs.String(), `level=DEBUG msg="dial websocket failed" url=ws://localhost:7979`)
+}
+
+func TestStats(t *testing.T) {
+	addr := "localhost:8095"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	for _, msg := range msgs {
+		_, err := c.Write(msg)
+		assert.Nil(t, err)
+	}
+	buf := make([]byte, 150)
+	for _, msg := range msgs[:2] {
+		n, err := c.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, buf[:n], "buffer matches message")
+	}
+
+	assert.Equal(t, ConnStats{
+		BytesRead:            int64(len(msg1) + len(msg2)),
+		BytesWritten:         int64(len(msg1) + len(msg2) + len(msg3)),
+		MessagesRead:         2,
+		MessagesWritten:      3,
+		KafkaMessagesWritten: 3,
+	}, c.(*Conn).Stats())
+}
+
+func TestBufferWritesStats(t *testing.T) {
+	addr := "localhost:8148"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, BufferWrites: true})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	conn := c.(*Conn)
+
+	// Three messages in one flush, then two more with the second split
+	// across a flush, which leaves its start buffered
+	for _, msg := range msgs {
+		_, err := c.Write(msg)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, conn.Flush())
+	_, err = c.Write(append(append([]byte{}, msg1...), msg2[:10]...))
+	assert.Nil(t, err)
+	assert.Nil(t, conn.Flush())
+	_, err = c.Write(msg2[10:])
+	assert.Nil(t, err)
+	assert.Nil(t, conn.Flush())
+
+	stats := conn.Stats()
+	assert.Equal(t, int64(3), stats.MessagesWritten)
+	assert.Equal(t, int64(5), stats.KafkaMessagesWritten)
+	assert.Equal(t, int64(len(msg1)+len(msg2)+len(msg3)+len(msg1)+len(msg2)), stats.BytesWritten)
+}
+
+func TestUpgrader(t *testing.T) {
+	addr := "localhost:8096"
+	l := ListenPipe(addr)
+	// Echoes the Kafka protocol stream using only the net.Conn interface,
+	// like a Kafka server would. io.Copy reads and writes arbitrary chunks, so
+	// this relies on the framing being handled symmetrically
+	u := NewUpgrader(UpgraderConfig{})
+	s := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	})}
+	go s.Serve(l)
+	defer s.Close()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// The messages are written while the echoes are read, since the server
+	// doesn't read the next message until its echo of the last one is read
+	written := make(chan error, 1)
+	go func() {
+		for _, msg := range msgs {
+			if _, err := c.Write(msg); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+	buf := make([]byte, 150)
+	for _, msg := range msgs {
+		n, err := c.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, buf[:n], "buffer matches message")
+	}
+	assert.Nil(t, <-written)
+	assert.Equal(t, int64(3), c.(*Conn).Stats().MessagesRead, "one websocket message per kafka message")
+}
+
+func TestServerHandler(t *testing.T) {
+	addr := "localhost:8158"
+	l := ListenPipe(addr)
+	// Only requests with the right token reach the handler
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", auth(NewServerHandler(func(c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	})))
+	s := http.Server{Handler: mux}
+	go s.Serve(l)
+	defer s.Close()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	_, err := d.Dial("tcp", addr)
+	assert.Equal(t, HandshakeStatusError{URL: "ws://" + addr, StatusCode: http.StatusUnauthorized}, err)
+
+	ctx := WithRequestHeader(context.Background(), http.Header{"Authorization": {"Bearer secret"}})
+	c, err := d.DialContext(ctx, "tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	_, err = c.Write(msg1)
+	assert.Nil(t, err)
+	buf := make([]byte, len(msg1))
+	_, err = io.ReadFull(c, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg1, buf)
+}
+
+func TestUpgraderRejectsPlainHTTP(t *testing.T) {
+	u := NewUpgrader(UpgraderConfig{})
+	w := httptest.NewRecorder()
+	c, err := u.Upgrade(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Nil(t, c)
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestWriteOversized(t *testing.T) {
+	addr := "localhost:8097"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// A header claiming 2GB fails right away, instead of buffering
+	n, err := c.Write([]byte{0x7f, 0xff, 0xff, 0xff, 'k'})
+	assert.Equal(t, 0, n)
+	assert.Equal(t, OversizedFrameError{Size: 1<<31 - 1, Max: DefaultMaxMessageSize}, err)
+
+	d = NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, MaxMessageSize: 100})
+	c, err = d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// The limit applies to the size in the header, which excludes the header
+	n, err = c.Write(msg1)
+	assert.Nil(t, err)
+	assert.Equal(t, len(msg1), n)
+	n, err = c.Write(msg3)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, OversizedFrameError{Size: 125, Max: 100}, err)
+}
+
+func TestWriteInvalidSize(t *testing.T) {
+	addr := "localhost:8157"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	for _, tc := range []struct {
+		header []byte
+		size   int
+	}{
+		{[]byte{0, 0, 0, 0}, 0},
+		// The size is signed, so the high bit makes it negative
+		{[]byte{0x80, 0, 0, 0}, -1 << 31},
+		{[]byte{0xff, 0xff, 0xff, 0xff}, -1},
+	} {
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+
+		// The message before the invalid size is still sent
+		n, err := c.Write(append(append([]byte(nil), msg1...), tc.header...))
+		assert.Equal(t, len(msg1), n)
+		assert.Equal(t, InvalidFrameSizeError{Size: tc.size}, err)
+		buf := make([]byte, len(msg1))
+		_, err = io.ReadFull(c, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, msg1, buf)
+
+		// Every later write fails the same way, without buffering anything
+		n, err = c.Write(msg2)
+		assert.Equal(t, 0, n)
+		assert.Equal(t, InvalidFrameSizeError{Size: tc.size}, err)
+		assert.Empty(t, c.(*Conn).wBuf)
+		c.Close()
+	}
+}
+
+func TestSetReadLimit(t *testing.T) {
+	addr := "localhost:8098"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	buf := make([]byte, 150)
+	c.(*Conn).SetReadLimit(int64(len(msg3)))
+	_, err = c.Write(msg3)
+	assert.Nil(t, err)
+	n, err := c.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg3, buf[:n], "message within the limit is read")
+
+	c.(*Conn).SetReadLimit(int64(len(msg3) - 1))
+	_, err = c.Write(msg3)
+	assert.Nil(t, err)
+	_, err = c.Read(buf)
+	assert.ErrorIs(t, err, websocket.ErrReadLimit, "message over the lowered limit fails")
+}
+
+func TestWebSocketBufferSizes(t *testing.T) {
+	d := NewDialer(DialerConfig{TLS: false, WebSocketReadBufferSize: 64 << 10, WebSocketWriteBufferSize: 32 << 10})
+	ws := d.wsDialer()
+	assert.Equal(t, 64<<10, ws.ReadBufferSize)
+	assert.Equal(t, 32<<10, ws.WriteBufferSize)
+
+	// Connections still work with the larger buffers
+	addr := "localhost:8152"
+	defer StartServer(addr, EchoHandler).Stop()
+	d = NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe,
+		WebSocketReadBufferSize: 64 << 10, WebSocketWriteBufferSize: 32 << 10})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	msg := MakeMsg(200<<10, 'a')
+	_, err = c.Write(msg)
+	assert.Nil(t, err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(c, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, buf)
+}
+
+// Counts the buffers taken from and returned to a write buffer pool
+type CountingPool struct {
+	sync.Pool
+	gets atomic.Int64
+	puts atomic.Int64
+}
+
+func (p *CountingPool) Get() interface{} {
+	p.gets.Add(1)
+	return p.Pool.Get()
+}
+
+func (p *CountingPool) Put(v interface{}) {
+	p.puts.Add(1)
+	p.Pool.Put(v)
+}
+
+func TestWebSocketWriteBufferPool(t *testing.T) {
+	addr := "localhost:8153"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	pool := &CountingPool{}
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, WebSocketWriteBufferPool: pool})
+	for i := 0; i < 2; i++ {
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+		_, err = c.Write(msg1)
+		assert.Nil(t, err)
+		buf := make([]byte, len(msg1))
+		_, err = io.ReadFull(c, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, msg1, buf)
+		c.Close()
+	}
+	assert.GreaterOrEqual(t, pool.gets.Load(), int64(2), "both connections use the pool")
+	assert.Equal(t, pool.gets.Load(), pool.puts.Load(), "buffers go back to the pool")
+
+	// Dialers that share buffers get the same pool for the same buffer size
+	shared := NewDialer(DialerConfig{ShareWebSocketWriteBuffers: true}).wsDialer().WriteBufferPool
+	assert.NotNil(t, shared)
+	assert.Same(t, shared, NewDialer(DialerConfig{ShareWebSocketWriteBuffers: true}).wsDialer().WriteBufferPool)
+	assert.NotSame(t, shared, NewDialer(DialerConfig{ShareWebSocketWriteBuffers: true,
+		WebSocketWriteBufferSize: 64 << 10}).wsDialer().WriteBufferPool)
+	assert.Same(t, pool, NewDialer(DialerConfig{ShareWebSocketWriteBuffers: true,
+		WebSocketWriteBufferPool: pool}).wsDialer().WriteBufferPool, "a configured pool takes precedence")
+	assert.Nil(t, NewDialer(DialerConfig{}).wsDialer().WriteBufferPool)
+}
+
+func TestEnableCompression(t *testing.T) {
+	addr := "localhost:8099"
+	l := ListenPipe(addr)
+	offers := make(chan string, 1)
+	u := NewUpgrader(UpgraderConfig{EnableCompression: true})
+	s := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offers <- r.Header.Get("Sec-WebSocket-Extensions")
+		c, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	})}
+	go s.Serve(l)
+	defer s.Close()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, EnableCompression: true})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Contains(t, <-offers, "permessage-deflate", "dialer offers compression")
+	assert.True(t, c.(*Conn).Compressed(), "compression is negotiated")
+
+	for _, msg := range msgs {
+		_, err := c.Write(msg)
+		assert.Nil(t, err)
+		buf := make([]byte, 150)
+		n, err := c.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, buf[:n], "buffer matches message")
+	}
+
+	// The upgrader accepts the offer
+	dialer := websocket.Dialer{EnableCompression: true, NetDialContext: DialPipe}
+	ws, resp, err := dialer.Dial("ws://"+addr, nil)
+	assert.Nil(t, err)
+	defer ws.Close()
+	<-offers
+	assert.Contains(t, resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate", "upgrader negotiates compression")
+}
+
+func TestCompressionDeclined(t *testing.T) {
+	addr := "localhost:8149"
+	l := ListenPipe(addr)
+	offers := make(chan string, 1)
+	// The broker doesn't support compression, so it ignores the offer
+	u := NewUpgrader(UpgraderConfig{})
+	s := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offers <- r.Header.Get("Sec-WebSocket-Extensions")
+		c, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		assert.False(t, c.(*Conn).Compressed(), "broker doesn't compress")
+		io.Copy(c, c)
+	})}
+	go s.Serve(l)
+	defer s.Close()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, EnableCompression: true})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err, "dial succeeds without compression")
+	defer c.Close()
+	assert.Contains(t, <-offers, "permessage-deflate", "dialer offers compression")
+	assert.False(t, c.(*Conn).Compressed(), "compression isn't negotiated")
+
+	for _, msg := range msgs {
+		_, err := c.Write(msg)
+		assert.Nil(t, err)
+		buf := make([]byte, 150)
+		n, err := c.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, buf[:n], "buffer matches message")
+	}
+}
+
+func TestListen(t *testing.T) {
+	// Listens on a port picked by the OS
+	l, err := Listen("localhost:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	served := make(chan error, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				served <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	d := NewDialer(DialerConfig{TLS: false})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	for _, msg := range msgs {
+		_, err := c.Write(msg)
+		assert.Nil(t, err)
+		buf := make([]byte, 150)
+		n, err := c.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, buf[:n], "buffer matches message")
+	}
+
+	assert.Nil(t, l.Close())
+	assert.ErrorIs(t, <-served, net.ErrClosed, "accept fails after close")
+
+	// The accepted connection outlives the listener
+	_, err = c.Write(msg1)
+	assert.Nil(t, err)
+	buf := make([]byte, 150)
+	n, err := c.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg1, buf[:n], "buffer matches message")
+}
+
+func TestWriteTimeout(t *testing.T) {
+	addr := "localhost:8101"
+	// Accepts the connection but never reads from it
+	stalled := make(chan struct{})
+	defer close(stalled)
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		<-stalled
+		return nil
+	}).Stop()
+
+	timeout := 100 * time.Millisecond
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, WriteTimeout: timeout})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// Writes succeed until the socket buffers fill up, then time out
+	msg := MakeMsg(1<<20, 'a')
+	for i := 0; i < 100; i++ {
+		start := time.Now()
+		_, err = c.Write(msg)
+		if err != nil {
+			assert.Less(t, time.Since(start), timeout+time.Second, "write fails soon after the timeout")
+			break
+		}
+	}
+	var netErr net.Error
+	assert.True(t, errors.As(err, &netErr) && netErr.Timeout(), "write times out")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr := "localhost:8102"
+	// Accepts the connection and then goes quiet, without even answering pings
+	quiet := make(chan struct{})
+	defer close(quiet)
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		<-quiet
+		return nil
+	}).Stop()
+
+	timeout := 100 * time.Millisecond
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, IdleTimeout: timeout})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	start := time.Now()
+	_, err = c.Read(make([]byte, 150))
+	elapsed := time.Since(start)
+	var netErr net.Error
+	assert.True(t, errors.As(err, &netErr) && netErr.Timeout(), "read times out")
+	assert.GreaterOrEqual(t, elapsed, timeout-10*time.Millisecond)
+	assert.Less(t, elapsed, timeout+time.Second, "read fails soon after the idle timeout")
+}
+
+func TestIdleTimeoutPong(t *testing.T) {
+	addr := "localhost:8103"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	timeout := 100 * time.Millisecond
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, IdleTimeout: timeout})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// The broker is idle, but answers pings while waiting for a request, so
+	// the read keeps going well past the idle timeout
+	done := make(chan error, 1)
+	buf := make([]byte, 150)
+	go func() {
+		_, err := c.Read(buf)
+		done <- err
+	}()
+	time.Sleep(3 * timeout)
+	_, err = c.Write(msg1)
+	assert.Nil(t, err)
+	assert.Nil(t, <-done)
+	assert.Equal(t, msg1, buf[:len(msg1)], "buffer matches message")
+}
+
+func TestURL(t *testing.T) {
+	l, err := NewUpgrader(UpgraderConfig{}).Listen("localhost:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	d := NewDialer(DialerConfig{TLS: false})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Equal(t, "ws://"+addr, c.(*Conn).URL().String())
+
+	// Changes to the returned URL don't affect the connection
+	c.(*Conn).URL().Host = "example.com"
+	assert.Equal(t, addr, c.(*Conn).URL().Host)
+
+	server := <-accepted
+	defer server.Close()
+	assert.Equal(t, "ws://"+addr+"/", server.(*Conn).URL().String(), "server sees the requested path")
+}
+
+func TestOrigin(t *testing.T) {
+	origin := "https://app.example.com"
+	l, err := NewUpgrader(UpgraderConfig{CheckOrigin: func(r *http.Request) bool {
+		return r.Header.Get("Origin") == origin
+	}}).Listen("localhost:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	_, err = NewDialer(DialerConfig{TLS: false}).Dial("tcp", addr)
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake, "missing origin is rejected")
+
+	_, err = NewDialer(DialerConfig{TLS: false, Origin: "https://evil.example.com"}).Dial("tcp", addr)
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake, "mismatched origin is rejected")
+
+	c, err := NewDialer(DialerConfig{TLS: false, Origin: origin}).Dial("tcp", addr)
+	assert.Nil(t, err, "matching origin is accepted")
+	if c != nil {
+		c.Close()
+	}
+}
+
+func TestWithRequestHeader(t *testing.T) {
+	addr := "localhost:8106"
+	headers := make(chan http.Header, 1)
+	l := ListenPipe(addr)
+	u := NewUpgrader(UpgraderConfig{CheckOrigin: func(r *http.Request) bool { return true }})
+	s := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		c, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		c.Close()
+	})}
+	go s.Serve(l)
+	defer s.Close()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, Origin: "https://app.example.com"})
+	ctx := WithRequestHeader(context.Background(), http.Header{"X-Forwarded-For": {"192.0.2.1"}})
+	c, err := d.DialContext(ctx, "tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	h := <-headers
+	assert.Equal(t, "192.0.2.1", h.Get("X-Forwarded-For"))
+	assert.Equal(t, "https://app.example.com", h.Get("Origin"), "origin is still sent")
+}
+
+func TestBufferWrites(t *testing.T) {
+	addr := "localhost:8107"
+	frames := make(chan []byte, 10)
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		for {
+			_, p, err := c.ReadMessage()
+			if err != nil {
+				close(frames)
+				return nil
+			}
+			frames <- p
+		}
+	}).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, BufferWrites: true})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+
+	var all []byte
+	for _, msg := range msgs {
+		n, err := c.Write(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, len(msg), n)
+		all = append(all, msg...)
+	}
+	// Nothing is sent until the flush, and then every message shares a frame
+	assert.Nil(t, c.(*Conn).Flush())
+	assert.Equal(t, all, <-frames, "frame contains every message")
+	assert.Equal(t, int64(1), c.(*Conn).Stats().MessagesWritten)
+
+	// A partial message stays buffered, and Close flushes the rest
+	_, err = c.Write(msg1[:10])
+	assert.Nil(t, err)
+	assert.Nil(t, c.(*Conn).Flush())
+	_, err = c.Write(msg1[10:])
+	assert.Nil(t, err)
+	_, err = c.Write(msg2)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Close())
+	assert.Equal(t, append(append([]byte{}, msg1...), msg2...), <-frames)
+	_, ok := <-frames
+	assert.False(t, ok, "no other frames were sent")
+}
+
+func TestConcurrentReadDeadline(t *testing.T) {
+	addr := "localhost:8108"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// Deadlines and limits are changed from another goroutine while reads are
+	// in progress, which the race detector would flag if it was unsafe
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			assert.Nil(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+			c.(*Conn).SetReadLimit(1 << 20)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	buf := make([]byte, 150)
+	for i := 0; i < 20; i++ {
+		for _, msg := range msgs {
+			_, err := c.Write(msg)
+			assert.Nil(t, err)
+			n, err := c.Read(buf)
+			assert.Nil(t, err)
+			assert.Equal(t, msg, buf[:n], "buffer matches message")
+		}
+	}
+	close(done)
+	<-stopped
+
+	// A deadline set while a read is blocked unblocks it
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.SetReadDeadline(time.Now())
+	}()
+	_, err = c.Read(buf)
+	var netErr net.Error
+	if assert.True(t, errors.As(err, &netErr)) {
+		assert.True(t, netErr.Timeout())
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	addr := "localhost:8109"
+	frames := make(chan []byte, 1000)
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		defer close(frames)
+		for {
+			_, p, err := c.ReadMessage()
+			if err != nil {
+				return nil
+			}
+			frames <- p
+		}
+	}).Stop()
+
+	// The idle timeout keeps pings going while Write is called from several
+	// goroutines, and Close races with all of them
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, IdleTimeout: 10 * time.Millisecond})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for _, msg := range msgs {
+		wg.Add(1)
+		go func(msg []byte) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if _, err := c.Write(msg); err != nil {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(msg)
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, c.Close())
+	wg.Wait()
+
+	// Every frame that arrived is a whole message, rather than parts of
+	// messages from different writes
+	count := 0
+	for frame := range frames {
+		assert.Contains(t, msgs, frame)
+		count++
+	}
+	assert.NotZero(t, count)
+}
+
+func TestCloseContext(t *testing.T) {
+	addr := "localhost:8110"
+	release := make(chan struct{})
+	defer close(release)
+	// Never reads, so writes stall once the socket buffers fill up
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		<-release
+		return nil
+	}).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+
+	written := make(chan error, 1)
+	go func() {
+		msg := MakeMsg(1<<20, 'a')
+		for {
+			if _, err := c.Write(msg); err != nil {
+				written <- err
+				return
+			}
+		}
+	}()
+	// Waits until the socket buffers are full, and writes stop making progress
+	last := int64(-1)
+	assert.Eventually(t, func() bool {
+		n := c.(*Conn).Stats().BytesWritten
+		stalled := n == last
+		last = n
+		return stalled
+	}, 10*time.Second, 200*time.Millisecond, "writes stall")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = c.(*Conn).CloseContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "close gives up at the deadline")
+	select {
+	case err := <-written:
+		assert.Error(t, err, "stalled write fails once the connection is closed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled write never returned")
+	}
+}
+
+func TestShimCloseError(t *testing.T) {
+	addr := "localhost:8111"
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4001, "auth expired"))
+		// Wait for the client to close
+		c.ReadMessage()
+		return nil
+	}).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	_, err = c.Read(make([]byte, 10))
+	var closeErr ShimCloseError
+	if assert.True(t, errors.As(err, &closeErr)) {
+		assert.Equal(t, 4001, closeErr.Code)
+		assert.Equal(t, "auth expired", closeErr.Reason)
+	}
+}
+
+func TestStripSizeHeader(t *testing.T) {
+	addr := "localhost:8112"
+	sizes := make(chan int, len(msgs))
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		// Echoes messages as they arrive, which is without size headers
+		for {
+			mt, p, err := c.ReadMessage()
+			if err != nil {
+				return nil
+			}
+			sizes <- len(p)
+			if err := c.WriteMessage(mt, p); err != nil {
+				return err
+			}
+		}
+	}).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, StripSizeHeader: true})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	buf := make([]byte, 150)
+	for _, msg := range msgs {
+		_, err := c.Write(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, len(msg)-int32Size, <-sizes, "size header is left off the wire")
+		n, err := c.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, buf[:n], "size header is restored by read")
+	}
+
+	d = NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, StripSizeHeader: true, StreamReads: true})
+	_, err = d.Dial("tcp", addr)
+	assert.Error(t, err)
+}
+
+func TestDialTimeout(t *testing.T) {
+	// Nothing listens on this port, so every attempt fails
+	addr := "localhost:8113"
+
+	d := NewDialer(DialerConfig{
+		TLS:            false,
+		NetDialContext: DialPipe,
+		RetryCount:     100,
+		RetryBackoff:   50 * time.Millisecond,
+		DialTimeout:    300 * time.Millisecond,
+	})
+	start := time.Now()
+	_, err := d.Dial("tcp", addr)
+	elapsed := time.Since(start)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.GreaterOrEqual(t, elapsed, 250*time.Millisecond)
+	assert.Less(t, elapsed, 2*time.Second, "retries stop at the dial timeout")
+}
+
+func TestReadBatchedFrame(t *testing.T) {
+	addr := "localhost:8114"
+	var frame []byte
+	for _, msg := range msgs {
+		frame = append(frame, msg...)
+	}
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		// Every message in a single frame, like a broker batching responses
+		if err := c.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			return err
+		}
+		c.ReadMessage()
+		return nil
+	}).Stop()
+
+	for _, streamReads := range []bool{false, true} {
+		d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, StreamReads: streamReads})
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+
+		// Reads messages the way a Kafka client does, using the size header
+		for _, msg := range msgs {
+			header := make([]byte, int32Size)
+			_, err := io.ReadFull(c, header)
+			assert.Nil(t, err)
+			body := make([]byte, binary.BigEndian.Uint32(header))
+			_, err = io.ReadFull(c, body)
+			assert.Nil(t, err)
+			assert.Equal(t, msg, append(header, body...), "message is split out of the frame")
+		}
+		assert.Equal(t, int64(1), c.(*Conn).Stats().MessagesRead)
+		c.Close()
+	}
+}
+
+func TestNewConn(t *testing.T) {
+	addr := "localhost:8115"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	ws, _, err := (&websocket.Dialer{NetDialContext: DialPipe}).Dial("ws://"+addr, nil)
+	assert.Nil(t, err)
+	c := NewConn(ws)
+	defer c.Close()
+	assert.Equal(t, "ws://"+ws.RemoteAddr().String(), c.(*Conn).URL().String())
+
+	buf := make([]byte, 150)
+	for _, msg := range msgs {
+		_, err := c.Write(msg)
+		assert.Nil(t, err)
+		n, err := c.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, buf[:n], "buffer matches message")
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	addr := "localhost:8116"
+	release := make(chan struct{})
+	defer close(release)
+	// Never responds
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		<-release
+		return nil
+	}).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = c.(*Conn).ReadContext(ctx, make([]byte, 10))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second, "read gives up at the context deadline")
+
+	// Already cancelled contexts fail right away
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = c.(*Conn).ReadContext(ctx, make([]byte, 10))
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestReadContextKeepsNewDeadline(t *testing.T) {
+	addr := "localhost:8159"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	conn := c.(*Conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctxDeadline, _ := ctx.Deadline()
+	done := make(chan error)
+	go func() {
+		_, err := conn.ReadContext(ctx, make([]byte, len(msg1)))
+		done <- err
+	}()
+
+	// Once the read is waiting with the deadline of ctx, another goroutine
+	// sets a new deadline, which the read doesn't replace when it's done
+	assert.Eventually(t, func() bool {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		return conn.readDeadline.Equal(ctxDeadline)
+	}, time.Second, time.Millisecond)
+	deadline := time.Now().Add(time.Hour)
+	assert.Nil(t, c.SetReadDeadline(deadline))
+	_, err = c.Write(msg1)
+	assert.Nil(t, err)
+	assert.Nil(t, <-done)
+	assert.Equal(t, deadline, conn.readDeadline)
+
+	// Without a new deadline, the one from before the read is restored
+	_, err = c.Write(msg1)
+	assert.Nil(t, err)
+	_, err = conn.ReadContext(ctx, make([]byte, len(msg1)))
+	assert.Nil(t, err)
+	assert.Equal(t, deadline, conn.readDeadline)
+}
+
+func TestFrameDump(t *testing.T) {
+	addr := "localhost:8117"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	var dump bytes.Buffer
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, FrameDump: &dump})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	msg := []byte{0, 0, 0, 2, 'h', 'i'}
+	_, err = c.Write(msg)
+	assert.Nil(t, err)
+	_, err = c.Read(make([]byte, 10))
+	assert.Nil(t, err)
+
+	assert.Equal(t, ""+
+		"send 6 bytes\n"+
+		"00000000  00 00 00 02 68 69                                 |....hi|\n"+
+		"recv 6 bytes\n"+
+		"00000000  00 00 00 02 68 69                                 |....hi|\n",
+		dump.String())
+}
+
+func TestHTTP2Only(t *testing.T) {
+	addr := "localhost:8118"
+	l := ListenPipe(addr)
+	defer l.Close()
+	// Only speaks HTTP/2 with prior knowledge, so it answers the upgrade
+	// request with its SETTINGS frame, followed by a GOAWAY frame
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Read(make([]byte, 1024))
+		conn.Write([]byte{
+			0, 0, 0, 0x4, 0, 0, 0, 0, 0,
+			0, 0, 8, 0x7, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		})
+	}()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	_, err := d.Dial("tcp", addr)
+	assert.Equal(t, HTTP2OnlyError("ws://"+addr), err)
+	assert.Contains(t, err.Error(), "enable http/1.1")
+}
+
+func TestLookupHost(t *testing.T) {
+	addr := "127.0.0.1:8119"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	var lookups []string
+	d := NewDialer(DialerConfig{
+		TLS:            false,
+		NetDialContext: DialPipe,
+		LookupHost: func(ctx context.Context, host string) ([]string, error) {
+			lookups = append(lookups, host)
+			// The first address refuses connections, so the next is tried
+			return []string{"127.0.0.2", "127.0.0.1"}, nil
+		},
+	})
+	for i := 0; i < 2; i++ {
+		c, err := d.Dial("tcp", "broker.invalid:8119")
+		assert.Nil(t, err)
+		if err == nil {
+			assert.Equal(t, "ws://broker.invalid:8119", c.(*Conn).URL().String())
+			c.Close()
+		}
+	}
+	assert.Equal(t, []string{"broker.invalid", "broker.invalid"}, lookups, "host is resolved on every dial")
+}
+
+func TestMaxWriteBuffer(t *testing.T) {
+	addr := "localhost:8120"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	for _, bufferWrites := range []bool{false, true} {
+		d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, MaxWriteBuffer: 16, BufferWrites: bufferWrites})
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+		defer c.Close()
+
+		// A complete message can be larger than the limit
+		_, err = c.Write(msg3)
+		assert.Nil(t, err)
+
+		// A header declaring 1MB is within the maximum message size, but the
+		// bytes trickling in after it never complete the message
+		_, err = c.Write([]byte{0, 0x10, 0, 0})
+		assert.Nil(t, err)
+		for i := 0; err == nil && i < 100; i++ {
+			_, err = c.Write([]byte{'k'})
+		}
+		assert.Equal(t, WriteBufferFullError{Size: 17, Max: 16}, err, "buffer writes: %v", bufferWrites)
+
+		// The byte that didn't fit isn't kept, so the partial message stays
+		// at the limit however many more writes fail. In buffered write mode,
+		// the complete message before it is still waiting for Flush
+		conn := c.(*Conn)
+		assert.Equal(t, 16, len(conn.wBuf[conn.wComplete:]))
+		_, err = c.Write([]byte("kkkk"))
+		assert.Equal(t, WriteBufferFullError{Size: 20, Max: 16}, err)
+		assert.Equal(t, 16, len(conn.wBuf[conn.wComplete:]))
+	}
+}
+
+func TestLastReadFromBuffer(t *testing.T) {
+	addr := "localhost:8121"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	for _, streamReads := range []bool{false, true} {
+		d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, StreamReads: streamReads})
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+		defer c.Close()
+
+		_, err = c.Write(msg3)
+		assert.Nil(t, err)
+
+		// The first read receives the message, and the second is served from
+		// the rest of it
+		b := make([]byte, len(msg3)/2)
+		_, err = io.ReadFull(c, b)
+		assert.Nil(t, err)
+		assert.False(t, c.(*Conn).LastReadFromBuffer(), "stream reads: %v", streamReads)
+		_, err = io.ReadFull(c, b)
+		assert.Nil(t, err)
+		assert.True(t, c.(*Conn).LastReadFromBuffer(), "stream reads: %v", streamReads)
+	}
+}
+
+func TestNetDialContext(t *testing.T) {
+	addr := "localhost:8122"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	var dialed []string
+	d := NewDialer(DialerConfig{
+		TLS: false,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return DialPipe(ctx, network, addr)
+		},
+	})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Equal(t, []string{addr}, dialed)
+
+	_, err = c.Write(msg1)
+	assert.Nil(t, err)
+	b := make([]byte, len(msg1))
+	_, err = io.ReadFull(c, b)
+	assert.Nil(t, err)
+	assert.Equal(t, msg1, b)
+}
+
+// Records the keepalive settings applied to a connection, as if it were a TCP
+// connection
+type KeepAliveRecorder struct {
+	net.Conn
+	enabled []bool
+	period  time.Duration
+}
+
+func (c *KeepAliveRecorder) SetKeepAlive(keepalive bool) error {
+	c.enabled = append(c.enabled, keepalive)
+	return nil
+}
+
+func (c *KeepAliveRecorder) SetKeepAlivePeriod(d time.Duration) error {
+	c.period = d
+	return nil
+}
+
+func TestTCPKeepAlive(t *testing.T) {
+	addr := "localhost:8134"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	for _, period := range []time.Duration{30 * time.Second, -1} {
+		var conn *KeepAliveRecorder
+		d := NewDialer(DialerConfig{
+			TLS:          false,
+			TCPKeepAlive: period,
+			NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				c, err := DialPipe(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				conn = &KeepAliveRecorder{Conn: c}
+				return conn, nil
+			},
+		})
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+		if assert.NotNil(t, conn) {
+			assert.Equal(t, []bool{period > 0}, conn.enabled)
+			if period > 0 {
+				assert.Equal(t, period, conn.period)
+			}
+		}
+		assert.Nil(t, c.Close())
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	addr := "localhost:8135"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+
+	// Only one of the calls closes the connection, and neither fails
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.Close()
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.Nil(t, c.Close())
+	_, err = c.Write(msg1)
+	assert.ErrorIs(t, err, ErrConnClosed)
+}
+
+func TestRaw(t *testing.T) {
+	addr := "localhost:8136"
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		if err := c.WriteControl(websocket.PingMessage, []byte("hello"), time.Now().Add(time.Second)); err != nil {
+			return nil
+		}
+		c.WriteMessage(websocket.BinaryMessage, msg1)
+		c.ReadMessage()
+		return nil
+	}).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	pings := make(chan string, 1)
+	c.(*Conn).Raw().SetPingHandler(func(data string) error {
+		pings <- data
+		return nil
+	})
+	// The ping is handled during the read
+	buf := make([]byte, len(msg1))
+	_, err = io.ReadFull(c, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg1, buf)
+	select {
+	case data := <-pings:
+		assert.Equal(t, "hello", data)
+	default:
+		t.Fatal("ping handler wasn't called")
+	}
+}
+
+func TestRequestHeader(t *testing.T) {
+	addr := "localhost:8137"
+	// The first connection is dropped, which makes the dialer reconnect
+	tokens := make(chan string, 10)
+	var dials atomic.Int32
+	l := ListenPipe(addr)
+	upgrader := websocket.Upgrader{}
+	s := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens <- r.Header.Get("Authorization")
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if dials.Add(1) == 1 {
+			return
+		}
+		EchoHandler(c)
+	})}
+	go s.Serve(l)
+	defer s.Close()
+
+	var calls atomic.Int32
+	d := NewDialer(DialerConfig{
+		TLS:            false,
+		NetDialContext: DialPipe,
+		Reconnect:      true,
+		RequestHeader: func(ctx context.Context) (http.Header, error) {
+			n := calls.Add(1)
+			return http.Header{"authorization": {fmt.Sprintf("Bearer token-%d", n)}}, nil
+		},
+	})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Equal(t, "Bearer token-1", <-tokens)
+
+	// The write fails on the first connection, and the redial gets a new token
+	_, err = c.Write(msg1)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer token-2", <-tokens)
+	buf := make([]byte, len(msg1))
+	_, err = io.ReadFull(c, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg1, buf)
+
+	// A callback error fails the dial
+	d = NewDialer(DialerConfig{
+		TLS:            false,
+		NetDialContext: DialPipe,
+		RequestHeader: func(ctx context.Context) (http.Header, error) {
+			return nil, errors.New("token expired")
+		},
+	})
+	_, err = d.Dial("tcp", addr)
+	assert.ErrorContains(t, err, "token expired")
+}
+
+func TestWriteRateLimit(t *testing.T) {
+	addr := "localhost:8138"
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return nil
+			}
+		}
+	}).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, WriteRateLimit: 2000})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// The first second's worth goes out in a burst, and the rest at the limit
+	msg := MakeMsg(96, 'a')
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		_, err := c.Write(msg)
+		assert.Nil(t, err)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 450*time.Millisecond, "writes are throttled")
+
+	// A write that can't be sent before the deadline fails right away
+	assert.Nil(t, c.SetWriteDeadline(time.Now().Add(10*time.Millisecond)))
+	start = time.Now()
+	_, err = c.Write(MakeMsg(1000, 'a'))
+	var netErr net.Error
+	assert.True(t, errors.As(err, &netErr) && netErr.Timeout(), "write times out")
+	assert.Less(t, time.Since(start), 100*time.Millisecond, "write fails without waiting")
+}
+
+func TestPooledDialer(t *testing.T) {
+	addr := "localhost:8139"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	p := NewPooledDialer(PooledDialerConfig{
+		Dialer:      NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe}),
+		IdleTimeout: 50 * time.Millisecond,
+	})
+	defer p.Close()
+
+	c1, err := p.Get(context.Background(), addr)
+	assert.Nil(t, err)
+	_, err = c1.Write(msg1)
+	assert.Nil(t, err)
+	buf := make([]byte, len(msg1))
+	_, err = io.ReadFull(c1, buf)
+	assert.Nil(t, err)
+	p.Put(c1)
+
+	// The idle connection is handed out again
+	c2, err := p.Get(context.Background(), addr)
+	assert.Nil(t, err)
+	assert.Same(t, c1.(*Conn).Raw(), c2.(*Conn).Raw())
+	_, err = c2.Write(msg2)
+	assert.Nil(t, err)
+	buf = make([]byte, len(msg2))
+	_, err = io.ReadFull(c2, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg2, buf)
+
+	// A connection with part of a request written can't be reused
+	_, err = c2.Write(msg1[:3])
+	assert.Nil(t, err)
+	p.Put(c2)
+	_, err = c2.Write(msg1[3:])
+	assert.ErrorIs(t, err, ErrConnClosed)
+
+	c3, err := p.Get(context.Background(), addr)
+	assert.Nil(t, err)
+	assert.NotSame(t, c2.(*Conn).Raw(), c3.(*Conn).Raw())
+	p.Put(c3)
+
+	// Idle connections are closed after the idle timeout
+	time.Sleep(200 * time.Millisecond)
+	_, err = c3.Write(msg1)
+	assert.ErrorIs(t, err, ErrConnClosed)
+	c4, err := p.Get(context.Background(), addr)
+	assert.Nil(t, err)
+	assert.NotSame(t, c3.(*Conn).Raw(), c4.(*Conn).Raw())
+	p.Put(c4)
+
+	assert.Nil(t, p.Close())
+	_, err = c4.Write(msg1)
+	assert.ErrorIs(t, err, ErrConnClosed, "idle connections are closed with the pool")
+	_, err = p.Get(context.Background(), addr)
+	assert.ErrorIs(t, err, ErrPoolClosed)
+}
+
+func TestPooledDialerReadLimit(t *testing.T) {
+	addr := "localhost:8160"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	p := NewPooledDialer(PooledDialerConfig{
+		Dialer: NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe}),
+	})
+	defer p.Close()
+
+	c1, err := p.Get(context.Background(), addr)
+	assert.Nil(t, err)
+	c1.(*Conn).SetReadLimit(int64(len(msg1)))
+	p.Put(c1)
+
+	// The next user isn't held to the limit set by the last one
+	c2, err := p.Get(context.Background(), addr)
+	assert.Nil(t, err)
+	assert.Same(t, c1, c2)
+	_, err = c2.Write(msg3)
+	assert.Nil(t, err)
+	buf := make([]byte, len(msg3))
+	_, err = io.ReadFull(c2, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg3, buf)
+}
+
+func TestFaults(t *testing.T) {
+	// The faults follow the draws from a random source with the same seed
+	const seed = 7
+	draws := rand.New(rand.NewSource(seed))
+	msgs := make([][]byte, 20)
+	for i := range msgs {
+		msgs[i] = MakeMsg(10, byte('a'+i))
+	}
+
+	t.Run("DroppedWrites", func(t *testing.T) {
+		addr := "localhost:8140"
+		received := make(chan []byte, len(msgs))
+		defer StartServer(addr, func(c *websocket.Conn) error {
+			defer close(received)
+			for {
+				_, p, err := c.ReadMessage()
+				if err != nil {
+					return nil
+				}
+				received <- p
+			}
+		}).Stop()
+
+		d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe,
+			Faults: &FaultConfig{DropProbability: 0.3, Seed: seed}})
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+		var expected [][]byte
+		draws.Seed(seed)
+		for _, msg := range msgs {
+			if draws.Float64() >= 0.3 {
+				expected = append(expected, msg)
+			}
+			_, err := c.Write(msg)
+			assert.Nil(t, err, "dropped writes succeed")
+		}
+		assert.Nil(t, c.Close())
+		var got [][]byte
+		for p := range received {
+			got = append(got, p)
+		}
+		assert.Equal(t, expected, got)
+		assert.Less(t, len(got), len(msgs), "some messages are dropped")
+	})
+
+	t.Run("DroppedReads", func(t *testing.T) {
+		addr := "localhost:8141"
+		defer StartServer(addr, func(c *websocket.Conn) error {
+			for _, msg := range msgs {
+				if err := c.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+					return nil
+				}
+			}
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			c.ReadMessage()
+			return nil
+		}).Stop()
+
+		for _, streamReads := range []bool{false, true} {
+			d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, StreamReads: streamReads,
+				Faults: &FaultConfig{DropProbability: 0.3, Seed: seed}})
+			c, err := d.Dial("tcp", addr)
+			assert.Nil(t, err)
+			var expected []byte
+			draws.Seed(seed)
+			for _, msg := range msgs {
+				if draws.Float64() >= 0.3 {
+					expected = append(expected, msg...)
+				}
+			}
+			got, err := io.ReadAll(c)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, got, "stream reads: %v", streamReads)
+			c.Close()
+		}
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		addr := "localhost:8142"
+		defer StartServer(addr, EchoHandler).Stop()
+
+		d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe,
+			Faults: &FaultConfig{DisconnectProbability: 0.2, Seed: seed}})
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+		defer c.Close()
+		// Each round trip draws once for the write and once for the read
+		draws.Seed(seed)
+		disconnect := 0
+		for draws.Float64() >= 0.2 {
+			disconnect++
+		}
+		assert.Less(t, disconnect, len(msgs)*2)
+		buf := make([]byte, len(msg1))
+		for i := 0; ; i += 2 {
+			_, err := c.Write(msg1)
+			if i == disconnect {
+				assert.ErrorIs(t, err, ErrInjectedDisconnect)
+				break
+			}
+			assert.Nil(t, err)
+			_, err = io.ReadFull(c, buf)
+			if i+1 == disconnect {
+				assert.ErrorIs(t, err, ErrInjectedDisconnect)
+				break
+			}
+			assert.Nil(t, err)
+		}
+		_, err = c.Write(msg1)
+		assert.NotNil(t, err, "connection stays disconnected")
+	})
+
+	t.Run("Latency", func(t *testing.T) {
+		addr := "localhost:8143"
+		defer StartServer(addr, EchoHandler).Stop()
+
+		d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe,
+			Faults: &FaultConfig{Latency: 20 * time.Millisecond}})
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+		defer c.Close()
+		start := time.Now()
+		buf := make([]byte, len(msg1))
+		for i := 0; i < 5; i++ {
+			_, err := c.Write(msg1)
+			assert.Nil(t, err)
+			_, err = io.ReadFull(c, buf)
+			assert.Nil(t, err)
+		}
+		assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond, "each message is delayed both ways")
+	})
+}
+
+func TestWriteQueue(t *testing.T) {
+	// Reads each message slowly, and reports how many it got once the client
+	// closes the connection
+	slowHandler := func(delay time.Duration, start <-chan struct{}, count chan<- int) func(*websocket.Conn) error {
+		return func(c *websocket.Conn) error {
+			<-start
+			n := 0
+			for {
+				if _, _, err := c.ReadMessage(); err != nil {
+					count <- n
+					return nil
+				}
+				n++
+				time.Sleep(delay)
+			}
+		}
+	}
+
+	t.Run("Blocking", func(t *testing.T) {
+		addr := "localhost:8145"
+		start := make(chan struct{})
+		close(start)
+		count := make(chan int, 1)
+		defer StartServer(addr, slowHandler(50*time.Millisecond, start, count)).Stop()
+
+		d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, WriteQueueSize: 3})
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+		begin := time.Now()
+		for i := 0; i < 3; i++ {
+			_, err := c.Write(msg1)
+			assert.Nil(t, err)
+		}
+		assert.Less(t, time.Since(begin), 40*time.Millisecond, "writes return before the broker reads")
+		// Once the queue fills, writes wait for the broker
+		for i := 0; i < 5; i++ {
+			_, err := c.Write(msg1)
+			assert.Nil(t, err)
+		}
+		assert.GreaterOrEqual(t, time.Since(begin), 150*time.Millisecond, "full queue applies backpressure")
+		assert.Nil(t, c.Close())
+		assert.Equal(t, 8, <-count, "close sends the queued messages")
+	})
+
+	t.Run("NonBlocking", func(t *testing.T) {
+		addr := "localhost:8146"
+		start := make(chan struct{})
+		count := make(chan int, 1)
+		defer StartServer(addr, slowHandler(0, start, count)).Stop()
+
+		d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe,
+			WriteQueueSize: 2, WriteQueueNonBlocking: true})
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+		// The broker doesn't read until start is closed, so the queue fills
+		// up behind the message the writer is stuck sending
+		written := 0
+		begin := time.Now()
+		for ; written < 10; written++ {
+			if _, err = c.Write(msg1); err != nil {
+				break
+			}
+		}
+		assert.ErrorIs(t, err, ErrWriteQueueFull)
+		assert.GreaterOrEqual(t, written, 2)
+		assert.Less(t, written, 10)
+		assert.Less(t, time.Since(begin), 40*time.Millisecond, "writes don't wait")
+
+		close(start)
+		assert.Nil(t, c.Close())
+		assert.Equal(t, written, <-count, "rejected writes aren't sent")
+	})
+
+	t.Run("SendFailure", func(t *testing.T) {
+		addr := "localhost:8147"
+		defer StartServer(addr, func(c *websocket.Conn) error {
+			return nil
+		}).Stop()
+
+		d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, WriteQueueSize: 2})
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+		defer c.Close()
+		// The broker is gone, so a queued message fails to send, which fails
+		// a later write
+		assert.Eventually(t, func() bool {
+			_, err := c.Write(msg1)
+			return err != nil
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+// Frames messages with a uvarint length prefix
+type VarintFramer struct{}
+
+func (VarintFramer) ReadFrame(p []byte) (int, int, error) {
+	size, n := binary.Uvarint(p)
+	if n == 0 {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	if n < 0 {
+		return 0, 0, errors.New("varint overflows")
+	}
+	return n, int(size), nil
+}
+
+func (VarintFramer) WriteFrame(dst []byte, msgLen int) []byte {
+	return binary.AppendUvarint(dst, uint64(msgLen))
+}
+
+func VarintMsg(length int, fill byte) []byte {
+	return append(binary.AppendUvarint(nil, uint64(length)), bytes.Repeat([]byte{fill}, length)...)
+}
+
+func TestInt32Framer(t *testing.T) {
+	var f Int32Framer
+	prefixLen, msgLen, err := f.ReadFrame(msg1)
+	assert.Nil(t, err)
+	assert.Equal(t, int32Size, prefixLen)
+	assert.Equal(t, len(msg1)-int32Size, msgLen)
+	assert.Equal(t, msg1[:int32Size], f.WriteFrame(nil, msgLen))
+
+	_, _, err = f.ReadFrame(msg1[:3])
+	assert.Equal(t, io.ErrUnexpectedEOF, err, "short prefix")
+}
+
+func TestFramer(t *testing.T) {
+	// Larger messages have longer prefixes
+	msgs := [][]byte{VarintMsg(10, 'a'), VarintMsg(300, 'b'), VarintMsg(20000, 'c')}
+	stream := bytes.Join(msgs, nil)
+
+	for i, strip := range []bool{false, true} {
+		addr := fmt.Sprintf("localhost:%d", 8154+i)
+		received := make(chan []byte, len(msgs))
+		// Reads every message before echoing them, since the client writes
+		// them all before reading
+		defer StartServer(addr, func(c *websocket.Conn) error {
+			var echoes [][]byte
+			for range msgs {
+				_, p, err := c.ReadMessage()
+				if err != nil {
+					return nil
+				}
+				received <- p
+				echoes = append(echoes, p)
+			}
+			for _, p := range echoes {
+				if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+					return nil
+				}
+			}
+			c.ReadMessage()
+			return nil
+		}).Stop()
+
+		d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, Framer: VarintFramer{}, StripSizeHeader: strip})
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+		// The second write ends partway through the prefix of the second
+		// message, which is held until the rest of it is written
+		for _, p := range [][]byte{stream[:12], stream[12:15], stream[15:]} {
+			n, err := c.Write(p)
+			assert.Nil(t, err)
+			assert.Equal(t, len(p), n)
+		}
+		for _, msg := range msgs {
+			expected := msg
+			if strip {
+				prefixLen, _, _ := VarintFramer{}.ReadFrame(msg)
+				expected = msg[prefixLen:]
+			}
+			assert.Equal(t, expected, <-received, "each message is sent on its own, strip: %v", strip)
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(c, buf)
+			assert.Nil(t, err)
+			assert.Equal(t, msg, buf, "read gets the prefix, strip: %v", strip)
+		}
+		c.Close()
+	}
+
+	// A malformed prefix fails the write
+	addr := "localhost:8156"
+	defer StartServer(addr, EchoHandler).Stop()
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, Framer: VarintFramer{}})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	_, err = c.Write(bytes.Repeat([]byte{0xff}, 11))
+	assert.ErrorContains(t, err, "varint overflows")
+
+	// So does a message over the size limit
+	c, err = NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, Framer: VarintFramer{}, MaxMessageSize: 100}).Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	_, err = c.Write(VarintMsg(300, 'a'))
+	assert.ErrorIs(t, err, OversizedFrameError{Size: 300, Max: 100})
+}
+
+func TestMetricsCallbacks(t *testing.T) {
+	addr := "localhost:8123"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	for _, streamReads := range []bool{false, true} {
+		var read, written, writes int
+		d := NewDialer(DialerConfig{
+			TLS:            false,
+			NetDialContext: DialPipe,
+			StreamReads:    streamReads,
+			OnRead:         func(n int) { read += n },
+			OnWrite: func(n int) {
+				written += n
+				writes++
+			},
+		})
+		c, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+		defer c.Close()
+
+		// Two messages in one write are sent as two WebSocket messages
+		_, err = c.Write(append(append([]byte{}, msg1...), msg2...))
+		assert.Nil(t, err)
+		_, err = c.Write(msg3)
+		assert.Nil(t, err)
+		total := len(msg1) + len(msg2) + len(msg3)
+		_, err = io.ReadFull(c, make([]byte, total))
+		assert.Nil(t, err)
+
+		assert.Equal(t, total, written, "stream reads: %v", streamReads)
+		assert.Equal(t, 3, writes, "stream reads: %v", streamReads)
+		assert.Equal(t, total, read, "stream reads: %v", streamReads)
+	}
+}
+
+func TestErrConnClosed(t *testing.T) {
+	addr := "localhost:8124"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+
+	// A Read that is blocked when the connection is closed fails the same way
+	readErr := make(chan error)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	assert.Eventually(t, func() bool {
+		if c.(*Conn).readMu.TryLock() {
+			c.(*Conn).readMu.Unlock()
+			return false
+		}
+		return true
+	}, time.Second, time.Millisecond)
+	assert.Nil(t, c.Close())
+	assert.ErrorIs(t, <-readErr, ErrConnClosed)
+
+	_, err = c.Write(msg1)
+	assert.ErrorIs(t, err, ErrConnClosed)
+	_, err = c.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrConnClosed)
+}
+
+func TestPongWhileIdle(t *testing.T) {
+	addr := "localhost:8125"
+	pongs := make(chan string, 1)
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		c.SetPongHandler(func(data string) error {
+			pongs <- data
+			return nil
+		})
+		if err := c.WriteControl(websocket.PingMessage, []byte("idle"), time.Now().Add(time.Second)); err != nil {
+			return err
+		}
+		// Reading is what processes the pong, until the client closes
+		c.ReadMessage()
+		return nil
+	}).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// Nothing is sent either way, but the pending Read answers the ping
+	go c.Read(make([]byte, 1))
+	select {
+	case data := <-pongs:
+		assert.Equal(t, "idle", data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping wasn't answered")
+	}
+}
+
+func TestDialerClose(t *testing.T) {
+	addr := "localhost:8126"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	assert.Nil(t, d.Close())
+	assert.Nil(t, d.Close())
+
+	// Connections that are already open keep working
+	_, err = c.Write(msg1)
+	assert.Nil(t, err)
+	b := make([]byte, len(msg1))
+	_, err = io.ReadFull(c, b)
+	assert.Nil(t, err)
+	assert.Equal(t, msg1, b)
+}
+
+func TestUserAgent(t *testing.T) {
+	userAgents := make(chan string, 1)
+	l, err := NewUpgrader(UpgraderConfig{CheckOrigin: func(r *http.Request) bool {
+		userAgents <- r.Header.Get("User-Agent")
+		return true
+	}}).Listen("localhost:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	c, err := NewDialer(DialerConfig{TLS: false}).Dial("tcp", addr)
+	assert.Nil(t, err)
+	c.Close()
+	assert.Equal(t, DefaultUserAgent+"/"+Version, <-userAgents)
+
+	c, err = NewDialer(DialerConfig{TLS: false, UserAgent: "my-app/1.2"}).Dial("tcp", addr)
+	assert.Nil(t, err)
+	c.Close()
+	assert.Equal(t, "my-app/1.2", <-userAgents)
+}
+
+func TestHandshakeStatus(t *testing.T) {
+	addr := "localhost:8128"
+	s := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "missing token", http.StatusUnauthorized)
+	})}
+	l := ListenPipe(addr)
+	go s.Serve(l)
+	defer s.Close()
+
+	_, err := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe}).Dial("tcp", addr)
+	assert.Equal(t, HandshakeStatusError{URL: "ws://" + addr, StatusCode: http.StatusUnauthorized}, err)
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+	assert.Contains(t, err.Error(), "401 Unauthorized")
+}
+
+func TestWriteBufferSize(t *testing.T) {
+	addr := "localhost:8129"
+	frames := make(chan []byte, 10)
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		for {
+			_, p, err := c.ReadMessage()
+			if err != nil {
+				return nil
+			}
+			frames <- p
+		}
+	}).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, WriteBufferSize: 1024})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	conn := c.(*Conn)
+	assert.Equal(t, 1024, cap(conn.wBuf))
+	backing := &conn.wBuf[:1][0]
+
+	// The partial message is moved to the front of the same backing array
+	// once the message before it is sent
+	_, err = c.Write(append(append([]byte{}, msg1...), msg2[:10]...))
+	assert.Nil(t, err)
+	assert.Equal(t, msg1, <-frames)
+	assert.Equal(t, msg2[:10], conn.wBuf)
+	assert.Equal(t, backing, &conn.wBuf[0])
+	_, err = c.Write(msg2[10:])
+	assert.Nil(t, err)
+	assert.Equal(t, msg2, <-frames)
+	assert.Empty(t, conn.wBuf)
+	assert.Equal(t, 1024, cap(conn.wBuf), "buffer is reused")
+}
+
+// Records each call to Write separately
+type WriteRecorder struct {
+	writes [][]byte
+}
+
+func (w *WriteRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, append([]byte{}, p...))
+	return len(p), nil
+}
+
+func TestCopyBetweenConns(t *testing.T) {
+	srcAddr, dstAddr := "localhost:8130", "localhost:8131"
+	defer StartServer(srcAddr, func(c *websocket.Conn) error {
+		for _, msg := range msgs {
+			if err := c.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return nil
+			}
+		}
+		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		// Wait for the client to close
+		c.ReadMessage()
+		return nil
+	}).Stop()
+	frames := make(chan []byte, 10)
+	defer StartServer(dstAddr, func(c *websocket.Conn) error {
+		for {
+			_, p, err := c.ReadMessage()
+			if err != nil {
+				return nil
+			}
+			frames <- p
+		}
+	}).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	src, err := d.Dial("tcp", srcAddr)
+	assert.Nil(t, err)
+	defer src.Close()
+	dst, err := d.Dial("tcp", dstAddr)
+	assert.Nil(t, err)
+	defer dst.Close()
+
+	// The copy ends without an error when the source closes normally
+	n, err := io.Copy(dst, src)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(bytes.Join(msgs, nil))), n)
+	for _, msg := range msgs {
+		assert.Equal(t, msg, <-frames, "each message keeps its own frame")
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	addr := "localhost:8132"
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		for _, msg := range msgs {
+			if err := c.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return nil
+			}
+		}
+		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		c.ReadMessage()
+		return nil
+	}).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// The rest of a partially read message is written on its own, and then
+	// every later message is written whole
+	p := make([]byte, 10)
+	_, err = io.ReadFull(c, p)
+	assert.Nil(t, err)
+	var w WriteRecorder
+	n, err := c.(*Conn).WriteTo(&w)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(bytes.Join(msgs, nil))-10), n)
+	assert.Equal(t, [][]byte{msg1[10:], msg2, msg3}, w.writes)
+	assert.Equal(t, int64(len(bytes.Join(msgs, nil))), c.(*Conn).Stats().BytesRead)
+}
+
+func TestReadFrom(t *testing.T) {
+	addr := "localhost:8133"
+	frames := make(chan []byte, 10)
+	defer StartServer(addr, func(c *websocket.Conn) error {
+		for {
+			_, p, err := c.ReadMessage()
+			if err != nil {
+				return nil
+			}
+			frames <- p
+		}
+	}).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// A reader without WriteTo makes io.Copy use ReadFrom. Reading a byte at
+	// a time checks that the messages are assembled from short reads
+	stream := append(bytes.Join(msgs, nil), msg1[:10]...)
+	n, err := io.Copy(c, iotest.OneByteReader(bytes.NewReader(stream)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(stream)), n)
+	for _, msg := range msgs {
+		assert.Equal(t, msg, <-frames)
+	}
+
+	// The partial message at the end is held until the rest is written
+	_, err = c.Write(msg1[10:])
+	assert.Nil(t, err)
+	assert.Equal(t, msg1, <-frames)
+
+	// A copy that continues a partial message from Write doesn't mistake the
+	// rest of it for a size header
+	_, err = c.Write(msg2[:7])
+	assert.Nil(t, err)
+	stream = append(append([]byte(nil), msg2[7:]...), msg3...)
+	n, err = io.Copy(c, iotest.OneByteReader(bytes.NewReader(stream)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(stream)), n)
+	assert.Equal(t, msg2, <-frames)
+	assert.Equal(t, msg3, <-frames)
+}
+
+func TestReadFromOversized(t *testing.T) {
+	addr := "localhost:8161"
+	defer StartServer(addr, EchoHandler).Stop()
+
+	d := NewDialer(DialerConfig{TLS: false, NetDialContext: DialPipe, MaxMessageSize: 100})
+	c, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// The copy stops at the oversized message, without reading its body. The
+	// reader is wrapped to hide WriteTo, so that io.Copy uses ReadFrom
+	r := bytes.NewReader(append(append([]byte(nil), msg1...), msg3...))
+	n, err := io.Copy(c, struct{ io.Reader }{r})
+	assert.Equal(t, OversizedFrameError{Size: 125, Max: 100}, err)
+	assert.Equal(t, int64(len(msg1)+4), n)
+	assert.Equal(t, len(msg3)-4, r.Len())
+}
+
+func TestReadBody(t *testing.T) {
+	// A size that overstates the body doesn't allocate the whole size
+	msg, err := readBody(bytes.NewReader([]byte("abc")), []byte{0, 0, 0, 0}, 1<<20)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 'a', 'b', 'c'}, msg)
+	assert.Less(t, cap(msg), 1024)
+
+	msg, err = readBody(iotest.OneByteReader(bytes.NewReader(bytes.Repeat([]byte{'k'}, 1000))), nil, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{'k'}, 1000), msg)
+}
+
+// Splits payload into well-formed Kafka protocol messages, each taking its size
+// from the next byte of payload, and splits their concatenation into the chunks
+// that are passed to Write, each taking its length from the next byte of cuts
+func FuzzWrite(f *testing.F) {
+	f.Add([]byte{3, 'a', 'b', 'c', 0, 2, 'd', 'e'}, []byte{1, 5, 2})
+	f.Add([]byte{1, 0, 1, 0}, []byte{4})
+	f.Add(bytes.Repeat([]byte{200}, 1000), []byte{0, 16, 255})
+
+	frames := make(chan []byte, 64)
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			_, p, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			frames <- p
+		}
+	}))
+	defer s.Close()
+	// The connection is shared by all inputs, since every input leaves the
+	// write buffer empty
+	var c net.Conn
+
+	f.Fuzz(func(t *testing.T, payload []byte, cuts []byte) {
+		if c == nil {
+			var err error
+			c, err = NewDialer(DialerConfig{TLS: false}).Dial("tcp", s.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		var msgs [][]byte
+		for len(payload) > 0 {
+			size := min(int(payload[0]), len(payload)-1)
+			if size == 0 {
+				// Write rejects empty messages, since Kafka messages
+				// always have a header
+				payload = payload[1:]
+				continue
+			}
+			msg := binary.BigEndian.AppendUint32(nil, uint32(size))
+			msgs = append(msgs, append(msg, payload[1:1+size]...))
+			payload = payload[1+size:]
+		}
+		stream := bytes.Join(msgs, nil)
+
+		// Each message is sent in its own frame, in order. The frames are
+		// checked as they arrive, so that the server keeps reading
+		checked := make(chan error, 1)
+		go func() {
+			for i, msg := range msgs {
+				select {
+				case frame := <-frames:
+					if !bytes.Equal(msg, frame) {
+						checked <- errors.Errorf("frame %d is %x but expected %x", i, frame, msg)
+						return
+					}
+				case <-time.After(5 * time.Second):
+					checked <- errors.Errorf("received %d of %d frames", i, len(msgs))
+					return
+				}
+			}
+			checked <- nil
+		}()
+
+		written := 0
+		for i := 0; len(stream[written:]) > 0; i++ {
+			n := len(stream) - written
+			if len(cuts) > 0 {
+				n = min(int(cuts[i%len(cuts)])+1, n)
+			}
+			m, err := c.Write(stream[written : written+n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Every byte of a chunk is accepted, including a partial message
+			// that is held until the rest of it is written
+			if m != n {
+				t.Fatalf("wrote %d bytes of a %d byte chunk", m, n)
+			}
+			written += n
+		}
+		if err := <-checked; err != nil {
+			t.Fatal(err)
+		}
+	})
+	if c != nil {
+		c.Close()
+	}
+}
+
+// Compares sending each Kafka protocol message in its own WebSocket message
+// with buffering them and sending them in one, by writing a burst of small
+// messages to an echo server and reading the echo back
+func BenchmarkWriteMessages(b *testing.B) {
+	for _, batched := range []bool{false, true} {
+		name := "PerMessage"
+		if batched {
+			name = "Batched"
+		}
+		b.Run(name, func(b *testing.B) {
+			benchmarkWriteMessages(b, batched, 16, 100)
+		})
+	}
+}
+
+func benchmarkWriteMessages(b *testing.B, batched bool, count int, length int32) {
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		EchoHandler(c)
+	}))
+	defer s.Close()
+
+	d := NewDialer(DialerConfig{TLS: false, BufferWrites: batched})
+	c, err := d.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := MakeMsg(length, 'a')
+	echo := make([]byte, count*len(msg))
+	b.SetBytes(int64(len(echo)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < count; j++ {
+			if _, err := c.Write(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if batched {
+			if err := c.(*Conn).Flush(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if _, err := io.ReadFull(c, echo); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Reads a stream of Kafka protocol messages that the server sends as fast as
+// it can, one per WebSocket message. The server runs in the same process, so
+// its allocations (for framing large messages) count towards the results too
+func BenchmarkRead(b *testing.B) {
+	for _, length := range []int32{100, 64 << 10} {
+		b.Run(fmt.Sprintf("%dB", length), func(b *testing.B) {
+			benchmarkRead(b, length, DialerConfig{TLS: false})
+		})
+	}
+}
+
+// Compares reading large fetch responses through WebSocket read buffers of
+// different sizes, where zero is the library default
+func BenchmarkWebSocketReadBufferSize(b *testing.B) {
+	for _, size := range []int{0, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			benchmarkRead(b, 1<<20, DialerConfig{TLS: false, WebSocketReadBufferSize: size})
+		})
+	}
+}
+
+func benchmarkRead(b *testing.B, length int32, cfg DialerConfig) {
+	msg := MakeMsg(length, 'a')
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			if err := c.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return
+			}
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewDialer(cfg).Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+
+	p := make([]byte, len(msg))
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := io.ReadFull(c, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Compares writing bursts of large produce requests on new connections with
+// and without a preallocated write buffer. The requests are written in 4 KiB
+// chunks, like the proxy does, so the buffer assembles every request
+func BenchmarkWriteBufferSize(b *testing.B) {
+	for _, size := range []int{0, 256 << 10} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			benchmarkWriteBufferSize(b, size)
+		})
+	}
+}
+
+func benchmarkWriteBufferSize(b *testing.B, size int) {
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// Messages are discarded without buffering them, which keeps the
+		// server's allocations out of the results
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				return
+			}
+		}
+	}))
+	defer s.Close()
+
+	d := NewDialer(DialerConfig{TLS: false, WriteBufferSize: size})
+	msg := MakeMsg(256<<10-int32Size, 'a')
+	b.SetBytes(int64(4 * len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c, err := d.Dial("tcp", s.Listener.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		for j := 0; j < 4; j++ {
+			for p := msg; len(p) > 0; p = p[min(4096, len(p)):] {
+				if _, err := c.Write(p[:min(4096, len(p))]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.StopTimer()
+		c.Close()
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,92 @@
+package shim
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// The time spent in each phase of establishing a connection with the broker.
+// Phases that didn't happen (like the TLS handshake for ws:// URLs, or DNS
+// resolution for IP addresses) are zero
+type DialTiming struct {
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	// From the end of the TCP connect (or TLS handshake) until the WebSocket
+	// upgrade response has been read
+	Upgrade time.Duration
+	Total   time.Duration
+}
+
+// Records the phases of a single dial using the httptrace hooks, which are
+// called by both the net package (DNS and TCP connect) and the WebSocket
+// dialer (TLS handshake)
+type dialTracer struct {
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	upgradeStart time.Time
+	timing       DialTiming
+}
+
+func newDialTracer() *dialTracer {
+	return &dialTracer{start: time.Now()}
+}
+
+func (t *dialTracer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timing.DNS = time.Since(t.dnsStart)
+		},
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			// Multiple addresses can be tried, possibly in parallel, so the
+			// connect phase starts with the first attempt
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if !t.connectStart.IsZero() {
+				t.timing.Connect = time.Since(t.connectStart)
+			}
+			t.upgradeStart = time.Now()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timing.TLSHandshake = time.Since(t.tlsStart)
+			t.upgradeStart = time.Now()
+		},
+	}
+}
+
+// Returns the timing of the dial, which must have returned
+func (t *dialTracer) finish() DialTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timing.Total = time.Since(t.start)
+	if !t.upgradeStart.IsZero() {
+		t.timing.Upgrade = time.Since(t.upgradeStart)
+	}
+	return t.timing
+}
@@ -0,0 +1,195 @@
+package shim
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// Accepts WebSocket connections from Dialer on the broker side, which is the
+// mirror image of Dialer. Each connection is returned as a net.Conn that reads
+// and writes the Kafka protocol using the same one message per WebSocket
+// message framing, so it can be handed to a Kafka server that expects a
+// net.Conn
+type Upgrader struct {
+	upgrader     websocket.Upgrader
+	streamReads  bool
+	logger       *slog.Logger
+	maxMsgSize   int
+	maxWriteBuf  int
+	writeBufSize int
+}
+
+type UpgraderConfig struct {
+	// Returns whether to accept a request based on its Origin header. If nil,
+	// only requests without an Origin header, or with an Origin header that
+	// matches the Host header, are accepted
+	CheckOrigin func(r *http.Request) bool
+	// See DialerConfig.StreamReads
+	StreamReads bool
+	// See DialerConfig.Logger
+	Logger *slog.Logger
+	// See DialerConfig.MaxMessageSize
+	MaxMessageSize int
+	// See DialerConfig.MaxWriteBuffer
+	MaxWriteBuffer int
+	// See DialerConfig.WriteBufferSize
+	WriteBufferSize int
+	// See DialerConfig.EnableCompression
+	EnableCompression bool
+}
+
+func NewUpgrader(cfg UpgraderConfig) *Upgrader {
+	u := &Upgrader{
+		upgrader: websocket.Upgrader{
+			CheckOrigin:       cfg.CheckOrigin,
+			EnableCompression: cfg.EnableCompression,
+		},
+		streamReads:  cfg.StreamReads,
+		logger:       cfg.Logger,
+		maxMsgSize:   cfg.MaxMessageSize,
+		maxWriteBuf:  cfg.MaxWriteBuffer,
+		writeBufSize: cfg.WriteBufferSize,
+	}
+	if u.maxMsgSize == 0 {
+		u.maxMsgSize = DefaultMaxMessageSize
+	}
+	if u.logger == nil {
+		u.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return u
+}
+
+// Upgrades the HTTP request to a WebSocket connection. If the upgrade fails,
+// an HTTP error response has already been written to w
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	ws, err := u.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		u.logger.Debug("upgrade websocket failed", "remote_addr", r.RemoteAddr, "error", err)
+		return nil, errors.Wrap(err, "shim: upgrade websocket failed")
+	}
+	u.logger.Debug("upgraded websocket", "remote_addr", ws.RemoteAddr().String())
+	// The extension is only negotiated if the client offered it
+	compressed := u.upgrader.EnableCompression && hasCompression(r.Header)
+	ws.EnableWriteCompression(compressed)
+	c := &Conn{
+		ws:          ws,
+		url:         url.URL{Scheme: "ws", Host: r.Host, Path: r.URL.Path},
+		streamReads: u.streamReads,
+		maxMsgSize:  u.maxMsgSize,
+		maxWriteBuf: u.maxWriteBuf,
+		wBuf:        make([]byte, 0, u.writeBufSize),
+		framer:      Int32Framer{},
+		logger:      u.logger,
+	}
+	if r.TLS != nil {
+		c.url.Scheme = "wss"
+	}
+	c.compressed.Store(compressed)
+	c.touch()
+	return c, nil
+}
+
+// Returns an http.Handler that upgrades each request to a WebSocket connection
+// from Dialer, using an Upgrader with the default config, and hands it to
+// onConn. Unlike Listen, this lets a broker mount the endpoint on its own
+// mux, behind its own middleware (such as for auth or logging)
+func NewServerHandler(onConn func(net.Conn)) http.Handler {
+	return NewUpgrader(UpgraderConfig{}).Handler(onConn)
+}
+
+// Returns an http.Handler that upgrades each request and hands the connection
+// to onConn, which is called on the request's goroutine. onConn owns the
+// connection, which isn't closed when onConn returns. Requests that fail to
+// upgrade get an HTTP error response, and onConn isn't called
+func (u *Upgrader) Handler(onConn func(net.Conn)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		onConn(c)
+	})
+}
+
+// Returns a listener on the TCP address addr that accepts WebSocket connections
+// from Dialer, using an Upgrader with the default config. This lets a Kafka
+// server with a net.Listener based accept loop serve clients that connect
+// through the shim
+func Listen(addr string) (net.Listener, error) {
+	return NewUpgrader(UpgraderConfig{}).Listen(addr)
+}
+
+// Returns a listener on the TCP address addr that upgrades incoming HTTP
+// requests (on any path) to WebSocket connections. Upgrades wait until the
+// connection is accepted, so a server that stops accepting applies
+// backpressure to new clients
+func (u *Upgrader) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "shim: listen failed")
+	}
+	l := &listener{addr: ln.Addr(), conns: make(chan net.Conn), done: make(chan struct{})}
+	l.srv = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		select {
+		case l.conns <- c:
+		case <-l.done:
+			c.Close()
+		}
+	})}
+	go func() {
+		err := l.srv.Serve(ln)
+		l.close(errors.Wrap(err, "shim: serve websocket failed"))
+	}()
+	return l, nil
+}
+
+// Implements net.Listener
+type listener struct {
+	addr  net.Addr
+	srv   *http.Server
+	conns chan net.Conn
+
+	// Closed when the listener stops accepting connections, at which point err
+	// says why
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func (l *listener) close(err error) {
+	l.closeOnce.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Stops accepting connections. Connections that were already accepted stay
+// open
+func (l *listener) Close() error {
+	l.close(net.ErrClosed)
+	return l.srv.Close()
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}